@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	agentHTTPClient    = &http.Client{Timeout: 10 * time.Second}
+	agentMaxRetries    = 3
+	agentRetryBackoff  = 500 * time.Millisecond
+	agentQueueInterval = 30 * time.Second
+	agentQueueMaxDelay = 10 * time.Minute
+	// agentQueueMaxAttempts moves queued payloads to the dead letters after
+	// this many failed attempts; 0 retries them forever.
+	agentQueueMaxAttempts = 0
+	// webhookSecret signs every POST to the agent when set (WEBHOOK_SECRET).
+	webhookSecret string
+)
+
+// configureAgentDelivery applies the agent delivery settings from the environment.
+func configureAgentDelivery() {
+	agentHTTPClient.Timeout = envDuration("AGENT_TIMEOUT", 10*time.Second)
+	agentMaxRetries = envInt("AGENT_MAX_RETRIES", 3)
+	agentRetryBackoff = envDuration("AGENT_RETRY_BACKOFF", 500*time.Millisecond)
+	agentQueueInterval = envDuration("AGENT_QUEUE_RETRY_INTERVAL", 30*time.Second)
+	agentQueueMaxDelay = envDuration("AGENT_QUEUE_MAX_BACKOFF", 10*time.Minute)
+	agentQueueMaxAttempts = envInt("AGENT_QUEUE_MAX_ATTEMPTS", 0)
+	webhookSecret = os.Getenv("WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		agentLog.Warnf("WEBHOOK_SECRET is not set, POSTs to the agent are not signed")
+	}
+}
+
+// signBody returns the hex HMAC-SHA256 of the given parts, keyed with
+// WEBHOOK_SECRET and prefixed with "sha256=".
+func signBody(parts ...[]byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest adds the signature headers to a POST to the agent:
+// X-Hub-Signature-256 signs the body alone, as GitHub does, and X-Signature
+// signs "<X-Signature-Timestamp>.<body>" so the agent can also reject
+// replayed requests whose timestamp is too old.
+func signRequest(req *http.Request, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Hub-Signature-256", signBody(body))
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+	req.Header.Set("X-Signature", signBody([]byte(timestamp+"."), body))
+}
+
+// postJSON posts data to url, retrying with exponential backoff on network
+// errors and 5xx responses. Client errors (4xx) are not retried. Payloads
+// that still can't be delivered are kept as dead letters.
+func postJSON(url string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error marshalling JSON for %s: %w", url, err)
+	}
+	start := time.Now()
+	attempts, err := postBodyAttempts(url, body)
+	if err != nil {
+		addDeadLetter(url, body, attempts, errors.Unwrap(err), start)
+	}
+	return err
+}
+
+// postBody posts an already encoded JSON body with the same retry policy as postJSON.
+func postBody(url string, body []byte) error {
+	_, err := postBodyAttempts(url, body)
+	return err
+}
+
+// postBodyAttempts is postBody, also returning the number of attempts made.
+func postBodyAttempts(url string, body []byte) (int, error) {
+	backoff := agentRetryBackoff
+	var lastErr error
+	attempts := 0
+	for attempts <= agentMaxRetries {
+		if attempts > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		attempts++
+		retryable, err := postOnce(url, body)
+		if err == nil {
+			return attempts, nil
+		}
+		lastErr = err
+		if !retryable {
+			break
+		}
+	}
+	return attempts, fmt.Errorf("failed to post to %s: %w", url, lastErr)
+}
+
+// postOnce makes a single POST attempt and reports whether a failure is worth retrying.
+func postOnce(url string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhookSecret != "" {
+		signRequest(req, body)
+	}
+	resp, err := agentHTTPClient.Do(req)
+	if err != nil {
+		agentPostFailures.Inc()
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		agentPostFailures.Inc()
+		return resp.StatusCode >= 500, fmt.Errorf("agent responded with %s", resp.Status)
+	}
+	return false, nil
+}
+
+// forwardToAgent delivers a message payload to the agent's /api/message
+// endpoint. Payloads that can't be delivered are persisted in the agent_queue
+// table and retried by drainAgentQueue, so messages survive agent outages and
+// restarts of this server.
+func forwardToAgent(payload interface{}) {
+	forwardToAgentPath("/api/message", payload)
+}
+
+// forwardToAgentPath delivers a payload to an agent endpoint with the same
+// queueing guarantees as forwardToAgent.
+func forwardToAgentPath(path string, payload interface{}) {
+	url := agentBaseURL + path
+	body, err := json.Marshal(payload)
+	if err != nil {
+		agentLog.Errorf("Error marshalling JSON for %s: %v", url, err)
+		return
+	}
+	publishEvent(path, body)
+
+	// Deliver behind anything already queued so the agent sees messages in order
+	pending, err := countQueuedAgentPayloads()
+	if err != nil {
+		agentLog.Errorf("Failed to inspect agent queue: %v", err)
+	}
+	if pending == 0 {
+		if err = postBody(url, body); err == nil {
+			return
+		}
+		agentLog.Warnf("Failed to deliver message to agent, queueing for retry: %v", err)
+	}
+	if err := enqueueAgentPayload(url, body, err); err != nil {
+		agentLog.Errorf("Failed to queue message for agent, dropping it: %v", err)
+	}
+}
+
+// drainAgentQueue periodically delivers queued payloads in the order they
+// were received. After a failure the oldest payload is retried with
+// exponential backoff, and later payloads wait behind it.
+func drainAgentQueue() {
+	ticker := time.NewTicker(agentQueueInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for {
+			item, err := nextAgentPayload()
+			if err != nil {
+				agentLog.Errorf("Failed to read agent queue: %v", err)
+				break
+			}
+			if item == nil || time.Now().Unix() < item.nextAttemptAt {
+				break
+			}
+			if _, err := postOnce(item.url, item.payload); err != nil {
+				if agentQueueMaxAttempts > 0 && item.attempts+1 >= agentQueueMaxAttempts {
+					// Give up on this payload so the ones behind it get delivered
+					addDeadLetter(item.url, item.payload, item.attempts+1, err, time.Unix(item.createdAt, 0))
+					if err := deleteAgentPayload(item.id); err != nil {
+						agentLog.Errorf("Failed to remove undeliverable message from agent queue: %v", err)
+						break
+					}
+					continue
+				}
+				delay := agentQueueDelay(item.attempts + 1)
+				agentLog.Warnf("Agent still unreachable, retrying queued message %d in %s: %v", item.id, delay, err)
+				if err := recordAgentFailure(item.id, err, delay); err != nil {
+					agentLog.Errorf("Failed to update agent queue: %v", err)
+				}
+				break
+			}
+			if err := deleteAgentPayload(item.id); err != nil {
+				agentLog.Errorf("Failed to remove delivered message from agent queue: %v", err)
+				break
+			}
+		}
+	}
+}
+
+// agentQueueDelay returns the backoff before the next attempt of a queued
+// payload that has failed the given number of times.
+func agentQueueDelay(attempts int) time.Duration {
+	delay := agentQueueInterval
+	for i := 1; i < attempts && delay < agentQueueMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > agentQueueMaxDelay {
+		delay = agentQueueMaxDelay
+	}
+	return delay
+}
+
+// queuedAgentPayload is a row of the agent_queue table.
+type queuedAgentPayload struct {
+	id            int64
+	url           string
+	payload       []byte
+	attempts      int
+	createdAt     int64
+	nextAttemptAt int64
+}
+
+func createAgentQueueTable() error {
+	if db == nil {
+		return fmt.Errorf("database connection is not initialized")
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS agent_queue (
+		id ` + db.autoIncrementKey() + `,
+		url TEXT NOT NULL,
+		payload ` + db.blobType() + ` NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		created_at BIGINT NOT NULL,
+		next_attempt_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create agent queue table: %w", err)
+	}
+	return nil
+}
+
+func enqueueAgentPayload(url string, payload []byte, lastErr error) error {
+	if db == nil {
+		return fmt.Errorf("database connection is not initialized")
+	}
+	attempts := 0
+	var errText sql.NullString
+	if lastErr != nil {
+		attempts = 1
+		errText = sql.NullString{String: lastErr.Error(), Valid: true}
+	}
+	now := time.Now()
+	_, err := db.Exec("INSERT INTO agent_queue (url, payload, attempts, last_error, created_at, next_attempt_at) VALUES (?, ?, ?, ?, ?, ?)",
+		url, payload, attempts, errText, now.Unix(), now.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to queue agent payload: %w", err)
+	}
+	return nil
+}
+
+// nextAgentPayload returns the oldest queued payload, or nil if the queue is empty.
+func nextAgentPayload() (*queuedAgentPayload, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database connection is not initialized")
+	}
+	var item queuedAgentPayload
+	err := db.QueryRow("SELECT id, url, payload, attempts, created_at, next_attempt_at FROM agent_queue ORDER BY id LIMIT 1").
+		Scan(&item.id, &item.url, &item.payload, &item.attempts, &item.createdAt, &item.nextAttemptAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch queued agent payload: %w", err)
+	}
+	return &item, nil
+}
+
+func recordAgentFailure(id int64, lastErr error, delay time.Duration) error {
+	_, err := db.Exec("UPDATE agent_queue SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?",
+		lastErr.Error(), time.Now().Add(delay).Unix(), id)
+	if err != nil {
+		return fmt.Errorf("failed to record agent delivery failure: %w", err)
+	}
+	return nil
+}
+
+func deleteAgentPayload(id int64) error {
+	if _, err := db.Exec("DELETE FROM agent_queue WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete queued agent payload: %w", err)
+	}
+	return nil
+}
+
+func countQueuedAgentPayloads() (int, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database connection is not initialized")
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM agent_queue").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count queued agent payloads: %w", err)
+	}
+	return count, nil
+}
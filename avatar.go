@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+)
+
+// maxAvatarBytes bounds profile picture downloads; full-size pictures are
+// well below it.
+const maxAvatarBytes = 5 << 20
+
+// avatarCache keeps downloaded profile pictures by JID and size (AVATAR_TTL,
+// AVATAR_CACHE_SIZE), so the agent can show avatars without a WhatsApp query
+// each time.
+var avatarCache *mediaCache
+
+type avatar struct {
+	data        []byte
+	contentType string
+}
+
+// fetchAvatar downloads a profile picture from the URL WhatsApp handed out.
+func fetchAvatar(ctx context.Context, url string) (*avatar, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAvatarBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAvatarBytes {
+		return nil, errMediaTooLarge
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return &avatar{data: data, contentType: contentType}, nil
+}
+
+// handleAvatar serves the profile picture of a user or group, or with
+// preview=true its low-resolution thumbnail. Pictures are proxied by default,
+// since WhatsApp's URLs expire; with redirect=true the client is sent to
+// WhatsApp's CDN instead, which saves the download here for clients that use
+// the picture right away.
+func handleAvatar(w http.ResponseWriter, r *http.Request) {
+	jid, err := parseRecipient(mux.Vars(r)["jid"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	preview := r.URL.Query().Get("preview") == "true"
+	redirect := r.URL.Query().Get("redirect") == "true"
+	key := jid.String()
+	if preview {
+		key += "/preview"
+	}
+	if cached, ok := avatarCache.Load(key); ok && !redirect {
+		pic := cached.(*avatar)
+		writeImage(w, pic.contentType, pic.data)
+		return
+	}
+
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	info, err := sess.client.GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{Preview: preview})
+	switch {
+	case errors.Is(err, whatsmeow.ErrProfilePictureNotSet), err == nil && info == nil:
+		http.Error(w, "No profile picture set", http.StatusNotFound)
+		return
+	case errors.Is(err, whatsmeow.ErrProfilePictureUnauthorized):
+		http.Error(w, "Profile picture is hidden from this account", http.StatusNotFound)
+		return
+	case err != nil:
+		writeOperationError(w, "Failed to get profile picture", err)
+		return
+	}
+	if redirect {
+		// The URL expires, so the redirect mustn't be cached
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, info.URL, http.StatusFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), downloadTimeout)
+	defer cancel()
+	pic, err := fetchAvatar(ctx, info.URL)
+	if errors.Is(err, errMediaTooLarge) {
+		// The picture comes from WhatsApp's CDN, not the client, so this
+		// isn't a 413
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{
+			"error":          fmt.Sprintf("Profile picture is larger than %d bytes", maxAvatarBytes),
+			"maxAvatarBytes": maxAvatarBytes,
+		})
+		return
+	} else if err != nil {
+		writeOperationError(w, "Failed to download profile picture", err)
+		return
+	}
+	avatarCache.Store(key, pic)
+	writeImage(w, pic.contentType, pic.data)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxBulkMessages caps the messages sent by one batch: the entries of an
+// /api/send/bulk call or the recipients of an /api/send call. Sends are
+// SEND_DELAY apart within the request, so the cap keeps a call at about a
+// minute with the default delay; larger batches are split by the caller.
+const maxBulkMessages = 100
+
+// waitSendDelay pauses sendDelay between two sends of a batch. It returns
+// false without waiting out the delay when ctx is done first, e.g. because
+// the client disconnected.
+func waitSendDelay(ctx context.Context) bool {
+	if sendDelay <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(sendDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// SendBulkRequest is the body of POST /api/send/bulk. Each entry is a
+// message to one recipient and takes the same fields as POST /api/send
+// (without recipients).
+type SendBulkRequest struct {
+	Messages []SendMessageRequest `json:"messages"`
+}
+
+// handleSendBulk sends a different message to each recipient in turn,
+// pausing sendDelay between sends. Individual failures, including rate
+// limiting, are reported per entry and don't stop the batch; a client that
+// disconnects does.
+func handleSendBulk(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SendBulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Messages) == 0 {
+		http.Error(w, "messages must not be empty", http.StatusBadRequest)
+		return
+	}
+	if len(req.Messages) > maxBulkMessages {
+		http.Error(w, fmt.Sprintf("at most %d messages can be sent at once", maxBulkMessages), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]SendResult, 0, len(req.Messages))
+	sent := 0
+	for i, msg := range req.Messages {
+		if i > 0 && !waitSendDelay(r.Context()) {
+			apiLog.Warnf("Bulk send cancelled by the client after %d of %d messages (%d sent)", i, len(req.Messages), sent)
+			return
+		}
+		if len(msg.Recipients) > 0 {
+			results = append(results, SendResult{JID: msg.JID, Error: "recipients is not supported in bulk sends, add one entry per recipient"})
+			continue
+		}
+		mentions, err := parseMentions(msg.Mentions)
+		if err != nil {
+			results = append(results, SendResult{JID: msg.JID, Error: err.Error()})
+			continue
+		}
+		result := sess.sendToRecipient(r.Context(), msg.JID, msg, mentions)
+		if result.Error == "" {
+			sent++
+		}
+		results = append(results, result)
+	}
+	apiLog.Infof("Bulk send: %d of %d messages sent", sent, len(req.Messages))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sent":    sent,
+		"failed":  len(req.Messages) - sent,
+		"results": results,
+	})
+}
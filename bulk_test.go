@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBatchRecipients(t *testing.T) {
+	recipients := func(n int) []string {
+		r := make([]string, n)
+		for i := range r {
+			r[i] = "9198000" + strconv.Itoa(10000+i)
+		}
+		return r
+	}
+	tests := []struct {
+		name       string
+		jid        string
+		recipients []string
+		want       int
+		wantErr    bool
+	}{
+		{name: "recipients only", recipients: recipients(3), want: 3},
+		{name: "jid comes first", jid: "919811111111", recipients: recipients(2), want: 3},
+		{name: "at the cap", recipients: recipients(maxBulkMessages), want: maxBulkMessages},
+		{name: "over the cap", recipients: recipients(maxBulkMessages + 1), wantErr: true},
+		{name: "jid pushes over the cap", jid: "919811111111", recipients: recipients(maxBulkMessages), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := batchRecipients(tt.jid, tt.recipients)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("batch of %d accepted", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("got %d recipients, want %d", len(got), tt.want)
+			}
+			if tt.jid != "" && got[0] != tt.jid {
+				t.Errorf("first recipient = %q, want %q", got[0], tt.jid)
+			}
+		})
+	}
+}
+
+func TestWaitSendDelay(t *testing.T) {
+	prev := sendDelay
+	sendDelay = time.Hour
+	t.Cleanup(func() { sendDelay = prev })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan bool)
+	go func() { done <- waitSendDelay(ctx) }()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("waitSendDelay() = true after the context was cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitSendDelay() slept through a cancelled context")
+	}
+
+	sendDelay = time.Millisecond
+	if !waitSendDelay(context.Background()) {
+		t.Error("waitSendDelay() = false without cancellation")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// ChatStateRequest is the body of the /api/chat/{archive,pin,mute}
+// endpoints. Value archives, pins or mutes the chat when true and undoes it
+// when false. MuteSeconds limits a mute; 0 mutes until unmuted.
+type ChatStateRequest struct {
+	JID         string `json:"jid"`
+	Value       bool   `json:"value"`
+	MuteSeconds int64  `json:"muteSeconds,omitempty"`
+}
+
+// ChatState is a chat's archive, pin and mute state as synced from WhatsApp.
+type ChatState struct {
+	JID      string `json:"jid"`
+	Archived bool   `json:"archived"`
+	Pinned   bool   `json:"pinned"`
+	Muted    bool   `json:"muted"`
+	// MutedUntil is empty for chats muted until they are unmuted.
+	MutedUntil     string `json:"mutedUntil,omitempty"`
+	MutedUntilUnix int64  `json:"mutedUntilUnix,omitempty"`
+}
+
+// chatState reads the chat settings whatsmeow keeps in the device store. They
+// are updated by every app state sync, including the one SendAppState runs
+// after a change, so they reflect changes made on the phone too.
+func (s *Session) chatState(ctx context.Context, jid types.JID) (ChatState, error) {
+	settings, err := s.client.Store.ChatSettings.GetChatSettings(ctx, jid)
+	if err != nil {
+		return ChatState{}, err
+	}
+	state := ChatState{JID: jid.String(), Archived: settings.Archived, Pinned: settings.Pinned}
+	if until := settings.MutedUntil; !until.IsZero() {
+		// WhatsApp stores mutes without an end as -1 (or no timestamp at all)
+		if until.Unix() <= 0 {
+			state.Muted = true
+		} else if until.After(time.Now()) {
+			state.Muted = true
+			state.MutedUntil = until.UTC().Format(time.RFC3339)
+			state.MutedUntilUnix = until.Unix()
+		}
+	}
+	return state, nil
+}
+
+// lastMessageKey returns the key and timestamp of the latest message the
+// session sessionID stored for a chat, which WhatsApp wants in an archive
+// action so that newer messages unarchive the chat again. Messages of other
+// sessions, or stored before messages were attributed to sessions, can't
+// vouch for this account's view of the chat, so it returns a nil key when
+// the session has none.
+func lastMessageKey(sessionID string, chat types.JID) (*waCommon.MessageKey, time.Time, error) {
+	var id, sender string
+	var fromMe bool
+	var timestamp int64
+	err := db.QueryRow("SELECT message_id, sender_jid, from_me, timestamp FROM messages WHERE chat_jid = ? AND session_id = ? ORDER BY timestamp DESC LIMIT 1",
+		chat.String(), sessionID).Scan(&id, &sender, &fromMe, &timestamp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, time.Time{}, nil
+	} else if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to load latest message: %w", err)
+	}
+	key := &waCommon.MessageKey{
+		RemoteJID: proto.String(chat.String()),
+		FromMe:    proto.Bool(fromMe),
+		ID:        proto.String(id),
+	}
+	if chat.Server == types.GroupServer && !fromMe {
+		key.Participant = proto.String(sender)
+	}
+	return key, time.Unix(timestamp, 0), nil
+}
+
+// chatStateRequest decodes a ChatStateRequest for a connected session,
+// answering with a 400 when it is invalid.
+func chatStateRequest(w http.ResponseWriter, r *http.Request) (*Session, types.JID, ChatStateRequest, bool) {
+	var req ChatStateRequest
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return nil, types.JID{}, req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, types.JID{}, req, false
+	}
+	if req.MuteSeconds < 0 {
+		http.Error(w, "muteSeconds can't be negative", http.StatusBadRequest)
+		return nil, types.JID{}, req, false
+	}
+	jid, err := parseRecipient(req.JID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, types.JID{}, req, false
+	}
+	return sess, jid, req, true
+}
+
+// sendChatState applies an app state patch to a chat and answers with the
+// resulting state.
+func sendChatState(w http.ResponseWriter, r *http.Request, sess *Session, jid types.JID, action string, patch appstate.PatchInfo) {
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	// SendAppState syncs the collection back, which updates the stored chat
+	// settings; the phone and other devices pick the change up from the server
+	if err := sess.client.SendAppState(ctx, patch); errors.Is(err, whatsmeow.ErrAppStateUpdate) {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "WhatsApp rejected the change: " + err.Error()})
+		return
+	} else if err != nil {
+		writeOperationError(w, "Failed to "+action+" chat", err)
+		return
+	}
+	state, err := sess.chatState(ctx, jid)
+	if err != nil {
+		http.Error(w, "Failed to read chat state: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// handleArchiveChat archives a chat, or unarchives it when value is false.
+// Archiving also unpins the chat.
+func handleArchiveChat(w http.ResponseWriter, r *http.Request) {
+	sess, jid, req, ok := chatStateRequest(w, r)
+	if !ok {
+		return
+	}
+	key, timestamp, err := lastMessageKey(sess.ID(), jid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendChatState(w, r, sess, jid, "archive", appstate.BuildArchive(jid, req.Value, timestamp, key))
+}
+
+func handlePinChat(w http.ResponseWriter, r *http.Request) {
+	sess, jid, req, ok := chatStateRequest(w, r)
+	if !ok {
+		return
+	}
+	sendChatState(w, r, sess, jid, "pin", appstate.BuildPin(jid, req.Value))
+}
+
+func handleMuteChat(w http.ResponseWriter, r *http.Request) {
+	sess, jid, req, ok := chatStateRequest(w, r)
+	if !ok {
+		return
+	}
+	sendChatState(w, r, sess, jid, "mute", appstate.BuildMute(jid, req.Value, time.Duration(req.MuteSeconds)*time.Second))
+}
+
+// handleGetChatState returns the archive, pin and mute state of the chat in
+// the jid query parameter.
+func handleGetChatState(w http.ResponseWriter, r *http.Request) {
+	sess, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	jid, err := parseRecipient(r.URL.Query().Get("jid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state, err := sess.chatState(r.Context(), jid)
+	if err != nil {
+		http.Error(w, "Failed to read chat state: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envDuration reads a duration such as "500ms" or "2s" from the environment,
+// returning def when the variable is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		log.Warnf("Invalid %s value %q, using default %s", key, raw, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads a non-negative integer from the environment, returning def
+// when the variable is unset or invalid.
+func envInt(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		log.Warnf("Invalid %s value %q, using default %d", key, raw, def)
+		return def
+	}
+	return n
+}
+
+// envBool reads a boolean such as "true" or "0" from the environment,
+// returning def when the variable is unset or invalid.
+func envBool(key string, def bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Warnf("Invalid %s value %q, using default %t", key, raw, def)
+		return def
+	}
+	return b
+}
+
+// envString reads a string from the environment, returning def when the
+// variable is unset.
+func envString(key, def string) string {
+	if raw := os.Getenv(key); raw != "" {
+		return raw
+	}
+	return def
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// contactNameTTL bounds how long a resolved name is reused before the contact
+// store is consulted again, so renamed contacts are eventually picked up.
+const contactNameTTL = 10 * time.Minute
+
+type cachedName struct {
+	name       string
+	resolvedAt time.Time
+}
+
+var contactNames sync.Map // user part of the JID -> cachedName
+
+// resolveContactName returns a human-readable name for a JID: the saved
+// contact name, push name or business name from the device stores, falling
+// back to the user part of the JID. Results are cached per user.
+func resolveContactName(jid types.JID) string {
+	if jid.IsEmpty() {
+		return ""
+	}
+	if cached, ok := contactNames.Load(jid.User); ok {
+		entry := cached.(cachedName)
+		if time.Since(entry.resolvedAt) < contactNameTTL {
+			return entry.name
+		}
+	}
+
+	name := jid.User
+	// Each session has its own contact list; use the first one that knows the JID
+	for _, s := range sessions.All() {
+		if s.ID() == "" {
+			continue
+		}
+		info, err := s.client.Store.Contacts.GetContact(context.Background(), jid.ToNonAD())
+		if err != nil || !info.Found {
+			continue
+		}
+		switch {
+		case info.FullName != "":
+			name = info.FullName
+		case info.PushName != "":
+			name = info.PushName
+		case info.BusinessName != "":
+			name = info.BusinessName
+		}
+		break
+	}
+	contactNames.Store(jid.User, cachedName{name: name, resolvedAt: time.Now()})
+	return name
+}
+
+// rememberPushName caches the push name carried by an incoming message for
+// senders the contact store doesn't know a name for yet.
+func rememberPushName(jid types.JID, pushName string) {
+	if jid.IsEmpty() || pushName == "" {
+		return
+	}
+	contactNames.Store(jid.User, cachedName{name: pushName, resolvedAt: time.Now()})
+}
+
+// Contact is an entry of GET /api/contacts.
+type Contact struct {
+	JID          string `json:"jid"`
+	FullName     string `json:"fullName,omitempty"`
+	FirstName    string `json:"firstName,omitempty"`
+	PushName     string `json:"pushName,omitempty"`
+	BusinessName string `json:"businessName,omitempty"`
+}
+
+// matches reports whether any of the contact's names or its JID contains the
+// lowercased query.
+func (c Contact) matches(query string) bool {
+	for _, field := range []string{c.JID, c.FullName, c.FirstName, c.PushName, c.BusinessName} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGetContacts lists the contacts known to a session, optionally
+// filtered by ?query= on names and numbers, sorted by JID.
+func handleGetContacts(w http.ResponseWriter, r *http.Request) {
+	sess, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	all, err := sess.client.Store.Contacts.GetAllContacts(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to retrieve contacts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("query")))
+	contacts := make([]Contact, 0, len(all))
+	for jid, info := range all {
+		contact := Contact{
+			JID:          jid.String(),
+			FullName:     info.FullName,
+			FirstName:    info.FirstName,
+			PushName:     info.PushName,
+			BusinessName: info.BusinessName,
+		}
+		if query == "" || contact.matches(query) {
+			contacts = append(contacts, contact)
+		}
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].JID < contacts[j].JID })
+	writeJSON(w, http.StatusOK, contacts)
+}
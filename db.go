@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// database is the connection shared by the messages and agent queue tables
+// and whatsmeow's device store. Queries are written with SQLite's "?"
+// placeholders and rewritten for Postgres by Exec, Query, QueryRow and
+// Prepare.
+type database struct {
+	*sql.DB
+	driver string
+}
+
+// openDatabase connects to the database selected by DB_DRIVER: a SQLite file
+// at DB_PATH (the default) or the Postgres server at DB_URL.
+func openDatabase() (*database, error) {
+	driver := os.Getenv("DB_DRIVER")
+	if driver == "" {
+		driver = "sqlite3"
+	}
+	var dsn string
+	switch driver {
+	case "sqlite3":
+		dbPath := os.Getenv("DB_PATH")
+		if dbPath == "" {
+			dbPath = "data/whatsapp.db"
+		}
+		// Ensure the database directory exists and fail fast if it isn't writable
+		if err := ensureWritable(dbPath); err != nil {
+			return nil, fmt.Errorf("database path %s is not usable: %w", dbPath, err)
+		}
+		dsn = sqliteDSN(dbPath, envDuration("DB_BUSY_TIMEOUT", 5*time.Second))
+	case "postgres":
+		if dsn = os.Getenv("DB_URL"); dsn == "" {
+			return nil, fmt.Errorf("DB_URL must be set when DB_DRIVER is postgres")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported DB_DRIVER %q, use sqlite3 or postgres", driver)
+	}
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := configurePool(conn, driver); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &database{DB: conn, driver: driver}, nil
+}
+
+// Default pool sizes. SQLite allows one writer at a time no matter how many
+// connections are open, and every connection beyond the busy ones just waits
+// out the busy timeout for the write lock, so its pool is kept small; WAL
+// lets its readers run alongside the writer. Postgres handles concurrent
+// writers itself and gets a larger pool.
+const (
+	defaultSQLiteMaxOpenConns   = 4
+	defaultPostgresMaxOpenConns = 20
+)
+
+// configurePool sizes the connection pool (DB_MAX_OPEN_CONNS,
+// DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME). Our own message writes already
+// go through the single storage writer, so the pool mostly serves history
+// reads and whatsmeow's device store. At least two connections are needed
+// for SQLite: with one, a read of the device store, e.g. a contact name,
+// would wait forever for the connection held by a history query.
+func configurePool(conn *sql.DB, driver string) error {
+	maxOpen := defaultPostgresMaxOpenConns
+	if driver == "sqlite3" {
+		maxOpen = defaultSQLiteMaxOpenConns
+	}
+	maxOpen = envInt("DB_MAX_OPEN_CONNS", maxOpen)
+	if maxOpen < 2 {
+		return fmt.Errorf("DB_MAX_OPEN_CONNS must be at least 2, got %d", maxOpen)
+	}
+	// Idle SQLite connections keep their page cache, so by default none are
+	// closed
+	maxIdle := envInt("DB_MAX_IDLE_CONNS", maxOpen)
+	if maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	conn.SetMaxOpenConns(maxOpen)
+	conn.SetMaxIdleConns(maxIdle)
+	conn.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", 0))
+	dbLog.Infof("Database pool: %d connections, %d idle", maxOpen, maxIdle)
+	return nil
+}
+
+func (d *database) isPostgres() bool {
+	return d.driver == "postgres"
+}
+
+// blobType is the column type for binary data.
+func (d *database) blobType() string {
+	if d.isPostgres() {
+		return "BYTEA"
+	}
+	return "BLOB"
+}
+
+// autoIncrementKey is the column definition of an auto-incrementing integer
+// primary key.
+func (d *database) autoIncrementKey() string {
+	if d.isPostgres() {
+		return "BIGSERIAL PRIMARY KEY"
+	}
+	return "INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+// rebind rewrites "?" placeholders to Postgres' numbered "$1" form. Queries
+// must not contain question marks in string literals.
+func (d *database) rebind(query string) string {
+	if !d.isPostgres() || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+func (d *database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.DB.Exec(d.rebind(query), args...)
+}
+
+func (d *database) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.DB.Query(d.rebind(query), args...)
+}
+
+func (d *database) QueryRow(query string, args ...interface{}) *sql.Row {
+	return d.DB.QueryRow(d.rebind(query), args...)
+}
+
+func (d *database) Prepare(query string) (*sql.Stmt, error) {
+	return d.DB.Prepare(d.rebind(query))
+}
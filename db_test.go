@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		query  string
+		want   string
+	}{
+		{
+			name:   "sqlite keeps placeholders",
+			driver: "sqlite3",
+			query:  "SELECT * FROM messages WHERE chat_jid = ? AND timestamp > ?",
+			want:   "SELECT * FROM messages WHERE chat_jid = ? AND timestamp > ?",
+		},
+		{
+			name:   "postgres numbers placeholders",
+			driver: "postgres",
+			query:  "SELECT * FROM messages WHERE chat_jid = ? AND timestamp > ?",
+			want:   "SELECT * FROM messages WHERE chat_jid = $1 AND timestamp > $2",
+		},
+		{
+			name:   "postgres past nine",
+			driver: "postgres",
+			query:  "VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			want:   "VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		},
+		{
+			name:   "postgres without placeholders",
+			driver: "postgres",
+			query:  "DELETE FROM messages",
+			want:   "DELETE FROM messages",
+		},
+		{
+			name:   "postgres keeps other characters",
+			driver: "postgres",
+			query:  "UPDATE messages SET message_content = ? WHERE message_id = ? -- édité",
+			want:   "UPDATE messages SET message_content = $1 WHERE message_id = $2 -- édité",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &database{driver: tt.driver}
+			if got := d.rebind(tt.query); got != tt.want {
+				t.Errorf("rebind() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// withMessagesDB points db at an in-memory SQLite database with the messages
+// table for the duration of a test.
+func withMessagesDB(t *testing.T) {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := db
+	db = &database{DB: conn, driver: "sqlite3"}
+	t.Cleanup(func() {
+		conn.Close()
+		db = prev
+	})
+	if err := createMessagesTable(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storeTestMessage stores a text message, failing the test on error.
+func storeTestMessage(t *testing.T, msgID string, chat, sender types.JID, fromMe bool, text string) {
+	t.Helper()
+	content, err := proto.Marshal(&waProto.Message{Conversation: proto.String(text)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storeMessage("919800000000", msgID, chat, sender, fromMe, content, time.Unix(1750000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
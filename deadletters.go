@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DeadLetter is a payload that could not be delivered to the agent: a
+// postJSON call that ran out of retries, or a queued payload that reached
+// AGENT_QUEUE_MAX_ATTEMPTS.
+type DeadLetter struct {
+	ID            int64           `json:"id"`
+	URL           string          `json:"url"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError,omitempty"`
+	CreatedAt     string          `json:"createdAt"`
+	CreatedAtUnix int64           `json:"createdAtUnix"`
+	FailedAt      string          `json:"failedAt"`
+	FailedAtUnix  int64           `json:"failedAtUnix"`
+}
+
+func createDeadLettersTable() error {
+	if db == nil {
+		return fmt.Errorf("database connection is not initialized")
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS dead_letters (
+		id ` + db.autoIncrementKey() + `,
+		url TEXT NOT NULL,
+		payload ` + db.blobType() + ` NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT,
+		created_at BIGINT NOT NULL,
+		failed_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create dead letters table: %w", err)
+	}
+	return nil
+}
+
+// addDeadLetter records a payload that won't be retried automatically.
+func addDeadLetter(url string, payload []byte, attempts int, lastErr error, createdAt time.Time) {
+	if db == nil {
+		return
+	}
+	var errText sql.NullString
+	if lastErr != nil {
+		errText = sql.NullString{String: lastErr.Error(), Valid: true}
+	}
+	_, err := db.Exec("INSERT INTO dead_letters (url, payload, attempts, last_error, created_at, failed_at) VALUES (?, ?, ?, ?, ?, ?)",
+		url, payload, attempts, errText, createdAt.Unix(), time.Now().Unix())
+	if err != nil {
+		agentLog.Errorf("Failed to record undeliverable payload for %s, dropping it: %v", url, err)
+		return
+	}
+	agentLog.Warnf("Gave up delivering payload to %s after %d attempts, see /api/deadletters", url, attempts)
+}
+
+func scanDeadLetter(row interface{ Scan(...interface{}) error }) (DeadLetter, error) {
+	var letter DeadLetter
+	var payload []byte
+	var lastErr sql.NullString
+	if err := row.Scan(&letter.ID, &letter.URL, &payload, &letter.Attempts, &lastErr, &letter.CreatedAtUnix, &letter.FailedAtUnix); err != nil {
+		return letter, err
+	}
+	letter.Payload = payload
+	letter.LastError = lastErr.String
+	letter.CreatedAt = time.Unix(letter.CreatedAtUnix, 0).UTC().Format(time.RFC3339)
+	letter.FailedAt = time.Unix(letter.FailedAtUnix, 0).UTC().Format(time.RFC3339)
+	return letter, nil
+}
+
+const deadLetterColumns = "id, url, payload, attempts, last_error, created_at, failed_at"
+
+func listDeadLetters() ([]DeadLetter, error) {
+	rows, err := db.Query("SELECT " + deadLetterColumns + " FROM dead_letters ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch dead letters: %w", err)
+	}
+	defer rows.Close()
+	letters := []DeadLetter{}
+	for rows.Next() {
+		letter, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dead letter: %w", err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+// getDeadLetter returns a dead letter by ID, or nil if there is none.
+func getDeadLetter(id int64) (*DeadLetter, error) {
+	letter, err := scanDeadLetter(db.QueryRow("SELECT "+deadLetterColumns+" FROM dead_letters WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to fetch dead letter: %w", err)
+	}
+	return &letter, nil
+}
+
+func deleteDeadLetter(id int64) error {
+	if _, err := db.Exec("DELETE FROM dead_letters WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete dead letter: %w", err)
+	}
+	return nil
+}
+
+func handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := listDeadLetters()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, letters)
+}
+
+// deadLetterFromRequest loads the dead letter named in the URL, answering
+// with a 404 when there is none.
+func deadLetterFromRequest(w http.ResponseWriter, r *http.Request) (*DeadLetter, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid dead letter ID", http.StatusBadRequest)
+		return nil, false
+	}
+	letter, err := getDeadLetter(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if letter == nil {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return nil, false
+	}
+	return letter, true
+}
+
+// handleRetryDeadLetter replays a dead letter once. It is removed when the
+// agent accepts it; otherwise the failure is recorded and the API answers
+// with a 502.
+func handleRetryDeadLetter(w http.ResponseWriter, r *http.Request) {
+	letter, ok := deadLetterFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, err := postOnce(letter.URL, letter.Payload); err != nil {
+		if _, dbErr := db.Exec("UPDATE dead_letters SET attempts = attempts + 1, last_error = ?, failed_at = ? WHERE id = ?",
+			err.Error(), time.Now().Unix(), letter.ID); dbErr != nil {
+			agentLog.Errorf("Failed to update dead letter %d: %v", letter.ID, dbErr)
+		}
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Failed to deliver payload: " + err.Error()})
+		return
+	}
+	if err := deleteDeadLetter(letter.ID); err != nil {
+		agentLog.Errorf("Delivered dead letter %d but failed to remove it: %v", letter.ID, err)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "delivered"})
+}
+
+func handleDeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	letter, ok := deadLetterFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := deleteDeadLetter(letter.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
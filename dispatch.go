@@ -0,0 +1,62 @@
+package main
+
+import (
+	"hash/fnv"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Worker pool settings applied to every session's dispatcher.
+var (
+	eventWorkers   = 4
+	eventQueueSize = 100
+)
+
+// eventDispatcher hands incoming messages and other events to a pool of
+// workers so slow work (history queries, database writes, agent POSTs)
+// doesn't block the whatsmeow event loop. Each chat is pinned to one worker,
+// which keeps the events of a chat in order while different chats are
+// processed concurrently.
+type eventDispatcher struct {
+	queues []chan func()
+	handle func(*events.Message)
+}
+
+// newEventDispatcher starts workers goroutines, each with a queue holding up
+// to queueSize pending events. Messages are passed to handle.
+func newEventDispatcher(workers, queueSize int, handle func(*events.Message)) *eventDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	d := &eventDispatcher{queues: make([]chan func(), workers), handle: handle}
+	for i := range d.queues {
+		queue := make(chan func(), queueSize)
+		d.queues[i] = queue
+		go func() {
+			for task := range queue {
+				task()
+			}
+		}()
+	}
+	return d
+}
+
+// Dispatch queues a message on the worker owning its chat.
+func (d *eventDispatcher) Dispatch(evt *events.Message) {
+	d.Run(evt.Info.Chat.String(), func() { d.handle(evt) })
+}
+
+// Run queues a task on the worker owning key, usually a chat JID, behind the
+// messages and events queued for it before. When that worker's queue is full,
+// Run blocks until there is room rather than dropping the task.
+func (d *eventDispatcher) Run(key string, task func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	queue := d.queues[h.Sum32()%uint32(len(d.queues))]
+	select {
+	case queue <- task:
+	default:
+		eventLog.Warnf("Event queue for %s is full, waiting for a worker", key)
+		queue <- task
+	}
+}
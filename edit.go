@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// editWindow is how long after sending WhatsApp accepts edits of a message.
+const editWindow = 15 * time.Minute
+
+// EditMessageRequest is the body of POST /api/edit.
+type EditMessageRequest struct {
+	JID       string `json:"jid"`
+	MessageID string `json:"messageID"`
+	Message   string `json:"message"`
+}
+
+// editedContent returns the new content of a stored message with its text
+// replaced. Only text messages and the captions of images, videos and
+// documents can be edited.
+func editedContent(stored *waProto.Message, text string) (*waProto.Message, error) {
+	switch {
+	case stored.GetConversation() != "", stored.GetExtendedTextMessage() != nil:
+		return &waProto.Message{Conversation: proto.String(text)}, nil
+	case stored.GetImageMessage() != nil, stored.GetVideoMessage() != nil, stored.GetDocumentMessage() != nil:
+		msg := proto.Clone(stored).(*waProto.Message)
+		msg.MessageContextInfo = nil
+		if m := msg.GetImageMessage(); m != nil {
+			m.Caption = proto.String(text)
+		} else if m := msg.GetVideoMessage(); m != nil {
+			m.Caption = proto.String(text)
+		} else {
+			msg.GetDocumentMessage().Caption = proto.String(text)
+		}
+		return msg, nil
+	}
+	return nil, fmt.Errorf("%w: only text messages and media captions can be edited", errInvalidMessage)
+}
+
+// handleEditMessage changes the text of one of our messages for everyone in
+// the chat. WhatsApp only accepts edits within editWindow of the send.
+func handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Message == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+	chat, message, ok := ownMessageOrError(w, sess, req.JID, req.MessageID)
+	if !ok {
+		return
+	}
+	sentAt, _ := message["timestampUnix"].(int64)
+	if age := time.Since(time.Unix(sentAt, 0)); age > editWindow {
+		http.Error(w, fmt.Sprintf("Messages can only be edited within %s of sending; this one was sent %s ago",
+			editWindow, age.Truncate(time.Second)), http.StatusConflict)
+		return
+	}
+	stored, err := loadStoredMessage(req.MessageID)
+	if errors.Is(err, errMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	content, err := editedContent(stored, req.Message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	// Like revokes, the edit itself isn't stored as a chat message
+	resp, err := sess.client.SendMessage(ctx, chat, sess.client.BuildEdit(chat, req.MessageID, content))
+	if err != nil {
+		writeOperationError(w, "Failed to edit message", err)
+		return
+	}
+	// WhatsApp doesn't echo our own edit back, so update the history here
+	serialized, err := proto.Marshal(content)
+	if err != nil {
+		dbLog.Errorf("Failed to serialize edited message %s: %v", req.MessageID, err)
+	} else if _, err := applyMessageEdit(req.MessageID, chat, serialized, time.Now(), sess.ownJIDs()...); err != nil {
+		dbLog.Errorf("Failed to update edited message %s: %v", req.MessageID, err)
+	}
+	writeJSON(w, http.StatusOK, newSendResult(chat, resp))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestApplyMessageEdit(t *testing.T) {
+	withMessagesDB(t)
+	chat := types.NewJID("120363000000000001", types.GroupServer)
+	other := types.NewJID("120363000000000002", types.GroupServer)
+	alice := types.NewJID("919811111111", types.DefaultUserServer)
+	aliceLID := types.NewJID("111111111", types.HiddenUserServer)
+	bob := types.NewJID("919822222222", types.DefaultUserServer)
+	// Alice sent this from her second device
+	storeTestMessage(t, "m1", chat, types.NewADJID(alice.User, 0, 2), false, "original")
+	storeTestMessage(t, "gone", chat, alice, false, "deleted")
+	if err := markMessageDeleted("gone", chat, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	edited, _ := proto.Marshal(&waProto.Message{Conversation: proto.String("edited")})
+	tests := []struct {
+		name    string
+		msgID   string
+		chat    types.JID
+		senders []types.JID
+		wantErr error
+	}{
+		{name: "other chat", msgID: "m1", chat: other, senders: []types.JID{alice}, wantErr: errMessageNotFound},
+		{name: "other sender", msgID: "m1", chat: chat, senders: []types.JID{bob}, wantErr: errNotMessageSender},
+		{name: "deleted", msgID: "gone", chat: chat, senders: []types.JID{alice}, wantErr: errMessageNotFound},
+		{name: "unknown", msgID: "m2", chat: chat, senders: []types.JID{alice}, wantErr: errMessageNotFound},
+		{name: "sender on another device", msgID: "m1", chat: chat, senders: []types.JID{aliceLID, types.NewADJID(alice.User, 0, 5)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous, err := applyMessageEdit(tt.msgID, tt.chat, edited, time.Now(), tt.senders...)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				if stored, _ := loadStoredMessage("m1"); stored.GetConversation() != "original" {
+					t.Errorf("rejected edit changed the message to %q", stored.GetConversation())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg waProto.Message
+			if err := proto.Unmarshal(previous, &msg); err != nil || msg.GetConversation() != "original" {
+				t.Errorf("previous content = %q, want the original", msg.GetConversation())
+			}
+			if stored, _ := loadStoredMessage("m1"); stored.GetConversation() != "edited" {
+				t.Errorf("stored content = %q, want the edit", stored.GetConversation())
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Disappearing message durations offered by WhatsApp, in seconds.
+const (
+	expiration24Hours = 24 * 60 * 60
+	expiration7Days   = 7 * expiration24Hours
+	expiration90Days  = 90 * expiration24Hours
+)
+
+// validateExpiration checks that a disappearing message duration is one
+// WhatsApp allows; 0 means the message doesn't disappear.
+func validateExpiration(seconds uint32) error {
+	switch seconds {
+	case 0, expiration24Hours, expiration7Days, expiration90Days:
+		return nil
+	}
+	return fmt.Errorf("%w: expirationSeconds must be %d (24 hours), %d (7 days) or %d (90 days)",
+		errInvalidMessage, expiration24Hours, expiration7Days, expiration90Days)
+}
+
+// setExpiration makes msg disappear after the given number of seconds by
+// setting the expiration in its ContextInfo, as WhatsApp clients do in chats
+// with disappearing messages on.
+func setExpiration(msg *waProto.Message, seconds uint32) {
+	info := messageContextInfo(msg)
+	if info == nil {
+		info = &waProto.ContextInfo{}
+		setContextInfo(msg, info)
+	}
+	info.Expiration = proto.Uint32(seconds)
+}
+
+// handleDisappearingTimer forwards a "disappearing_timer" event to the agent
+// when someone turns disappearing messages on or off in a chat.
+func handleDisappearingTimer(agentMsg AgentMessage, protoMsg *waProto.ProtocolMessage) {
+	eventLog.Infof("Disappearing messages in %s set to %ds", agentMsg.ChatJID, protoMsg.GetEphemeralExpiration())
+	agentMsg.Content.Type = "disappearing_timer"
+	messagesReceived.WithLabelValues(agentMsg.Content.Type).Inc()
+	agentMsg.Content.ExpirationSeconds = protoMsg.GetEphemeralExpiration()
+	forwardToAgent(map[string]interface{}{
+		"message": agentMsg,
+	})
+}
+
+// DisappearingTimerRequest is the body of POST /api/disappearing.
+// ExpirationSeconds 0 turns disappearing messages off.
+type DisappearingTimerRequest struct {
+	JID               string `json:"jid"`
+	ExpirationSeconds uint32 `json:"expirationSeconds"`
+}
+
+// handleSetDisappearingTimer turns disappearing messages on or off for a
+// whole chat, so every later message disappears without setting
+// expirationSeconds on each send.
+func handleSetDisappearingTimer(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req DisappearingTimerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateExpiration(req.ExpirationSeconds); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok {
+		return
+	}
+	if err := sess.client.SetDisappearingTimer(jid, time.Duration(req.ExpirationSeconds)*time.Second); err != nil {
+		writeOperationError(w, "Failed to set disappearing messages", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"jid":               jid.String(),
+		"expirationSeconds": req.ExpirationSeconds,
+	})
+}
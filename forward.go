@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// ForwardRequest is the body of POST /api/forward.
+type ForwardRequest struct {
+	MessageID string `json:"messageID"`
+	JID       string `json:"jid"`
+}
+
+// buildForwardMessage turns a stored message into a forward of it. Quotes,
+// mentions and timers of the original chat are dropped and the forwarding
+// score is raised, which is how WhatsApp marks messages as forwarded (and
+// "forwarded many times" from a score of 5). Media is uploaded again, since
+// the original upload may have expired.
+func (s *Session) buildForwardMessage(ctx context.Context, to types.JID, messageID string, stored *waProto.Message) (*waProto.Message, error) {
+	msg := proto.Clone(stored).(*waProto.Message)
+	switch {
+	case msg.GetReactionMessage() != nil, msg.GetPollUpdateMessage() != nil, msg.GetProtocolMessage() != nil:
+		return nil, fmt.Errorf("%w: reactions, poll votes and protocol messages can't be forwarded", errInvalidMessage)
+	case pollCreation(msg) != nil:
+		return nil, fmt.Errorf("%w: polls can't be forwarded", errInvalidMessage)
+	}
+	// Message secrets belong to the original message
+	msg.MessageContextInfo = nil
+
+	if media, ok := messageMedia(msg).(whatsmeow.DownloadableMessage); ok {
+		if err := s.reuploadMedia(ctx, to, messageID, msg, media); err != nil {
+			return nil, err
+		}
+	}
+
+	score := messageContextInfo(msg).GetForwardingScore() + 1
+	setContextInfo(msg, &waProto.ContextInfo{
+		IsForwarded:     proto.Bool(true),
+		ForwardingScore: proto.Uint32(score),
+	})
+	return msg, nil
+}
+
+// reuploadMedia uploads the media of msg again, from the saved copy when
+// there is one, and points msg at the new upload.
+func (s *Session) reuploadMedia(ctx context.Context, to types.JID, messageID string, msg *waProto.Message, media whatsmeow.DownloadableMessage) error {
+	if meta, ok := media.(mediaMetadata); ok && exceedsMaxMediaBytes(meta.GetFileLength()) {
+		return errMediaTooLarge
+	}
+	var data []byte
+	var err error
+	if f, openErr := openSavedMedia(messageID); openErr == nil {
+		data, err = io.ReadAll(f)
+		f.Close()
+	} else {
+		data, err = s.client.Download(ctx, media)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download media: %w", err)
+	}
+	uploaded, err := s.uploadMedia(ctx, to, data, whatsmeow.GetMediaType(media))
+	if err != nil {
+		return err
+	}
+	switch m := messageMedia(msg).(type) {
+	case *waProto.ImageMessage:
+		m.URL, m.DirectPath, m.MediaKey = proto.String(uploaded.URL), proto.String(uploaded.DirectPath), uploaded.MediaKey
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	case *waProto.VideoMessage:
+		m.URL, m.DirectPath, m.MediaKey = proto.String(uploaded.URL), proto.String(uploaded.DirectPath), uploaded.MediaKey
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	case *waProto.DocumentMessage:
+		m.URL, m.DirectPath, m.MediaKey = proto.String(uploaded.URL), proto.String(uploaded.DirectPath), uploaded.MediaKey
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	case *waProto.AudioMessage:
+		m.URL, m.DirectPath, m.MediaKey = proto.String(uploaded.URL), proto.String(uploaded.DirectPath), uploaded.MediaKey
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	case *waProto.StickerMessage:
+		m.URL, m.DirectPath, m.MediaKey = proto.String(uploaded.URL), proto.String(uploaded.DirectPath), uploaded.MediaKey
+		m.FileEncSHA256, m.FileSHA256, m.FileLength = uploaded.FileEncSHA256, uploaded.FileSHA256, proto.Uint64(uploaded.FileLength)
+	}
+	return nil
+}
+
+// handleForward forwards a stored message to another chat.
+func handleForward(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req ForwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.MessageID == "" {
+		http.Error(w, "messageID is required", http.StatusBadRequest)
+		return
+	}
+	stored, err := loadStoredMessage(req.MessageID)
+	if errors.Is(err, errMessageNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok || !allowSend(w, jid) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), downloadTimeout+sendTimeout)
+	defer cancel()
+	msg, err := sess.buildForwardMessage(ctx, jid, req.MessageID, stored)
+	if err != nil {
+		writeMediaSendError(w, "Failed to prepare forward", err)
+		return
+	}
+	resp, err := sess.sendMessage(ctx, jid, msg)
+	if err != nil {
+		writeOperationError(w, "Failed to forward message", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSendResult(jid, resp))
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// maxGroupSubjectLength is the longest group subject WhatsApp accepts, in
+// characters.
+const maxGroupSubjectLength = 100
+
+// GroupEvent describes a change to a group's members or settings, posted to
+// the agent's /api/group-event. Only the fields of changes that happened are
+// set. Added and Removed include members who joined or left by themselves,
+// in which case ActorJID is the member.
+type GroupEvent struct {
+	SessionID  string    `json:"sessionID,omitempty"`
+	GroupJID   string    `json:"groupJID"`
+	ActorJID   string    `json:"actorJID,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	Added      []string  `json:"added,omitempty"`
+	Removed    []string  `json:"removed,omitempty"`
+	Promoted   []string  `json:"promoted,omitempty"`
+	Demoted    []string  `json:"demoted,omitempty"`
+	JoinReason string    `json:"joinReason,omitempty"`
+	Subject    *string   `json:"subject,omitempty"`
+	Topic      *string   `json:"topic,omitempty"`
+}
+
+// handleGroupInfo forwards membership and subject changes of a group to the
+// agent so it can keep its member roster current. It runs on the session's
+// dispatcher, in order with the group's messages.
+func (s *Session) handleGroupInfo(v *events.GroupInfo) {
+	evt := GroupEvent{
+		SessionID:  s.ID(),
+		GroupJID:   v.JID.String(),
+		Timestamp:  v.Timestamp,
+		Added:      jidStrings(v.Join),
+		Removed:    jidStrings(v.Leave),
+		Promoted:   jidStrings(v.Promote),
+		Demoted:    jidStrings(v.Demote),
+		JoinReason: v.JoinReason,
+	}
+	if v.Sender != nil {
+		evt.ActorJID = v.Sender.String()
+	}
+	if v.Name != nil {
+		evt.Subject = &v.Name.Name
+	}
+	if v.Topic != nil {
+		evt.Topic = &v.Topic.Topic
+	}
+	if evt.Added == nil && evt.Removed == nil && evt.Promoted == nil && evt.Demoted == nil && evt.Subject == nil && evt.Topic == nil {
+		eventLog.Debugf("Ignoring group info update for %s without member or subject changes", v.JID)
+		return
+	}
+
+	eventLog.Infof("Group %s changed by %s (added %d, removed %d, promoted %d, demoted %d)",
+		v.JID, evt.ActorJID, len(evt.Added), len(evt.Removed), len(evt.Promoted), len(evt.Demoted))
+	forwardToAgentPath("/api/group-event", evt)
+}
+
+// handleJoinedGroup reports being added to a group, which WhatsApp sends as
+// a JoinedGroup event rather than a GroupInfo one. It is forwarded like other
+// member changes, with our own JID in Added and the group's subject.
+func (s *Session) handleJoinedGroup(v *events.JoinedGroup) {
+	id := s.JID()
+	if id.IsEmpty() {
+		return
+	}
+	evt := GroupEvent{
+		SessionID:  s.ID(),
+		GroupJID:   v.JID.String(),
+		Timestamp:  time.Now(),
+		Added:      []string{id.ToNonAD().String()},
+		JoinReason: v.Reason,
+	}
+	if v.Sender != nil {
+		evt.ActorJID = v.Sender.String()
+	}
+	if v.Name != "" {
+		evt.Subject = &v.Name
+	}
+	eventLog.Infof("Joined group %s (added by %s)", v.JID, evt.ActorJID)
+	forwardToAgentPath("/api/group-event", evt)
+}
+
+// jidStrings converts JIDs to their string form, keeping nil for no JIDs.
+func jidStrings(jids []types.JID) []string {
+	if len(jids) == 0 {
+		return nil
+	}
+	out := make([]string, len(jids))
+	for i, jid := range jids {
+		out[i] = jid.String()
+	}
+	return out
+}
+
+// CreateGroupRequest is the body of POST /api/group/create.
+type CreateGroupRequest struct {
+	Subject      string   `json:"subject"`
+	Participants []string `json:"participants"`
+}
+
+// GroupParticipantResult reports a member of a group change. Error is the
+// WhatsApp error code when the member couldn't be changed, e.g. 403 when
+// their privacy settings only allow being invited, 408 when they recently
+// left, or 409 when they already are a member.
+type GroupParticipantResult struct {
+	JID     string `json:"jid"`
+	IsAdmin bool   `json:"isAdmin,omitempty"`
+	// Status is "ok" or a name for Error, see participantStatus.
+	Status string `json:"status"`
+	Error  int    `json:"error,omitempty"`
+}
+
+// participantStatus names the error codes WhatsApp returns per member of a
+// group change.
+func participantStatus(code int) string {
+	switch code {
+	case 0, http.StatusOK:
+		return "ok"
+	case http.StatusForbidden:
+		return "invite_required"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusRequestTimeout:
+		return "recently_left"
+	case http.StatusConflict:
+		return "already_member"
+	case http.StatusInternalServerError:
+		return "group_full"
+	}
+	return "error"
+}
+
+// CreateGroupResponse describes a newly created group.
+type CreateGroupResponse struct {
+	GroupJID     string                   `json:"groupJID"`
+	Subject      string                   `json:"subject"`
+	InviteLink   string                   `json:"inviteLink,omitempty"`
+	Participants []GroupParticipantResult `json:"participants"`
+	Warning      string                   `json:"warning,omitempty"`
+}
+
+// parseParticipants parses group member JIDs or phone numbers, rejecting
+// anything that isn't a user.
+func parseParticipants(raw []string) ([]types.JID, error) {
+	jids := make([]types.JID, 0, len(raw))
+	for _, participant := range raw {
+		jid, err := parseRecipient(participant)
+		if err != nil {
+			return nil, err
+		}
+		if jid.Server != types.DefaultUserServer && jid.Server != types.HiddenUserServer {
+			return nil, fmt.Errorf("%w: group members must be users, not %q", errInvalidRecipient, participant)
+		}
+		jids = append(jids, jid)
+	}
+	return jids, nil
+}
+
+// participantResults converts the members returned for a group change.
+func participantResults(participants []types.GroupParticipant) []GroupParticipantResult {
+	results := make([]GroupParticipantResult, len(participants))
+	for i, participant := range participants {
+		results[i] = GroupParticipantResult{
+			JID:     participant.JID.String(),
+			IsAdmin: participant.IsAdmin || participant.IsSuperAdmin,
+			Status:  participantStatus(participant.Error),
+			Error:   participant.Error,
+		}
+	}
+	return results
+}
+
+// handleCreateGroup creates a group with the given members, with this
+// account as its admin, and returns its JID and invite link. Members that
+// can't be added directly are reported with their error code and can be sent
+// the invite link instead.
+func handleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req CreateGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Subject == "" || utf8.RuneCountInString(req.Subject) > maxGroupSubjectLength {
+		http.Error(w, fmt.Sprintf("subject is required and may have at most %d characters", maxGroupSubjectLength), http.StatusBadRequest)
+		return
+	}
+	participants, err := parseParticipants(req.Participants)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := sess.client.CreateGroup(whatsmeow.ReqCreateGroup{Name: req.Subject, Participants: participants})
+	if err != nil {
+		writeGroupError(w, "Failed to create group", err)
+		return
+	}
+	apiLog.Infof("Created group %s with %d members", info.JID, len(info.Participants))
+	resp := CreateGroupResponse{
+		GroupJID:     info.JID.String(),
+		Subject:      info.Name,
+		Participants: participantResults(info.Participants),
+	}
+	if link, err := sess.client.GetGroupInviteLink(info.JID, false); err != nil {
+		apiLog.Warnf("Created group %s but failed to get its invite link: %v", info.JID, err)
+		resp.Warning = "Failed to get the invite link: " + err.Error()
+	} else {
+		resp.InviteLink = link
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// UpdateParticipantsRequest is the body of the POST
+// /api/group/{jid}/{add,remove,promote,demote} endpoints.
+type UpdateParticipantsRequest struct {
+	Participants []string `json:"participants"`
+}
+
+// groupFromRequest parses the group JID in the URL, answering with a 400
+// when it isn't one.
+func groupFromRequest(w http.ResponseWriter, r *http.Request) (types.JID, bool) {
+	jid, err := parseRecipient(mux.Vars(r)["jid"])
+	if err == nil && jid.Server != types.GroupServer {
+		err = fmt.Errorf("%w: %q is not a group", errInvalidRecipient, mux.Vars(r)["jid"])
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return types.JID{}, false
+	}
+	return jid, true
+}
+
+// writeGroupError answers a failed group operation, with a 403 when this
+// account isn't an admin or member of the group, a 404 when the group
+// doesn't exist and a 410 for revoked invite links.
+func writeGroupError(w http.ResponseWriter, message string, err error) {
+	switch {
+	case errors.Is(err, whatsmeow.ErrNotInGroup):
+		http.Error(w, message+": this account isn't a member of the group", http.StatusForbidden)
+	case errors.Is(err, whatsmeow.ErrIQForbidden), errors.Is(err, whatsmeow.ErrIQNotAuthorized),
+		errors.Is(err, whatsmeow.ErrGroupInviteLinkUnauthorized):
+		http.Error(w, message+": this account isn't an admin of the group: "+err.Error(), http.StatusForbidden)
+	case errors.Is(err, whatsmeow.ErrIQNotFound), errors.Is(err, whatsmeow.ErrGroupNotFound):
+		http.Error(w, message+": group not found", http.StatusNotFound)
+	case errors.Is(err, whatsmeow.ErrInviteLinkRevoked):
+		http.Error(w, message+": the invite link has been revoked", http.StatusGone)
+	case errors.Is(err, whatsmeow.ErrInviteLinkInvalid):
+		http.Error(w, message+": the invite link is invalid", http.StatusBadRequest)
+	case errors.Is(err, whatsmeow.ErrIQNotAcceptable), errors.Is(err, whatsmeow.ErrIQBadRequest):
+		http.Error(w, message+": "+err.Error(), http.StatusBadRequest)
+	default:
+		writeOperationError(w, message, err)
+	}
+}
+
+// handleUpdateParticipants adds, removes, promotes or demotes group members,
+// as selected by the {action} route variable. WhatsApp applies the change
+// per member, so the response lists each member's result rather than failing
+// as a whole.
+func handleUpdateParticipants(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	group, ok := groupFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req UpdateParticipantsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Participants) == 0 {
+		http.Error(w, "participants is required", http.StatusBadRequest)
+		return
+	}
+	participants, err := parseParticipants(req.Participants)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := whatsmeow.ParticipantChange(mux.Vars(r)["action"])
+	updated, err := sess.client.UpdateGroupParticipants(group, participants, action)
+	if err != nil {
+		writeGroupError(w, "Failed to "+string(action)+" participants", err)
+		return
+	}
+	apiLog.Infof("Group %s: %s %d participants", group, action, len(participants))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"groupJID":     group.String(),
+		"action":       action,
+		"participants": participantResults(updated),
+	})
+}
+
+// JoinGroupRequest is the body of POST /api/group/join. Link is an invite
+// link or just its code.
+type JoinGroupRequest struct {
+	Link string `json:"link"`
+}
+
+// inviteCode extracts the code from an invite link, accepting links without
+// the scheme as they are often shared.
+func inviteCode(link string) string {
+	link = strings.TrimSuffix(strings.TrimSpace(link), "/")
+	return link[strings.LastIndex(link, "/")+1:]
+}
+
+// writeGroupInviteLink answers with a group's invite link. With reset the
+// current link is revoked and a new one generated; only admins may do either.
+func writeGroupInviteLink(w http.ResponseWriter, r *http.Request, reset bool) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	group, ok := groupFromRequest(w, r)
+	if !ok {
+		return
+	}
+	link, err := sess.client.GetGroupInviteLink(group, reset)
+	if err != nil {
+		writeGroupError(w, "Failed to get invite link", err)
+		return
+	}
+	if reset {
+		apiLog.Infof("Revoked invite link of group %s", group)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"groupJID": group.String(), "inviteLink": link, "revoked": reset})
+}
+
+func handleGetGroupInvite(w http.ResponseWriter, r *http.Request) {
+	writeGroupInviteLink(w, r, false)
+}
+
+// handleRevokeGroupInvite invalidates a group's invite link, e.g. after it
+// leaked, and returns the new one.
+func handleRevokeGroupInvite(w http.ResponseWriter, r *http.Request) {
+	writeGroupInviteLink(w, r, true)
+}
+
+// handleJoinGroup joins a group through an invite link. For groups that
+// require admin approval, the join stays pending until an admin approves it.
+func handleJoinGroup(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req JoinGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	code := inviteCode(req.Link)
+	if code == "" {
+		http.Error(w, "link is required", http.StatusBadRequest)
+		return
+	}
+	group, err := sess.client.JoinGroupWithLink(code)
+	if err != nil {
+		writeGroupError(w, "Failed to join group", err)
+		return
+	}
+	apiLog.Infof("Joined group %s through an invite link", group)
+	writeJSON(w, http.StatusOK, map[string]string{"groupJID": group.String()})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxHistoryBatchChats caps the chats fetched by one /api/history/batch call.
+const maxHistoryBatchChats = 100
+
+// HistoryBatchRequest is the body of POST /api/history/batch. Limit is the
+// number of most recent messages returned per chat (default 10).
+type HistoryBatchRequest struct {
+	Chats []string `json:"chats"`
+	Limit int      `json:"limit,omitempty"`
+}
+
+// getChatHistories returns the last limit messages of each chat, sorted
+// chronologically, in a single query. Deleted messages are omitted. Every
+// requested chat is present in the result, with no messages if none are
+// stored.
+func getChatHistories(chatJIDs []string, limit int) (map[string][]map[string]interface{}, error) {
+	histories := make(map[string][]map[string]interface{}, len(chatJIDs))
+	if len(chatJIDs) == 0 {
+		return histories, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chatJIDs)), ",")
+	args := make([]interface{}, 0, len(chatJIDs)+1)
+	for _, chat := range chatJIDs {
+		histories[chat] = []map[string]interface{}{}
+		args = append(args, chat)
+	}
+	args = append(args, limit)
+	query := `SELECT ` + messageColumns + ` FROM (
+		SELECT ` + messageColumns + `,
+			ROW_NUMBER() OVER (PARTITION BY chat_jid ORDER BY timestamp DESC) AS recency
+		FROM messages WHERE deleted = 0 AND chat_jid IN (` + placeholders + `)
+	) ranked WHERE recency <= ? ORDER BY chat_jid, timestamp ASC`
+	messages, err := executeMessageQuery(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		chat, _ := msg["chat"].(string)
+		histories[chat] = append(histories[chat], msg)
+	}
+	return histories, nil
+}
+
+// handleHistoryBatch returns the recent history of several chats at once,
+// e.g. for an agent warming up after a restart.
+func handleHistoryBatch(w http.ResponseWriter, r *http.Request) {
+	var req HistoryBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Chats) == 0 {
+		http.Error(w, "chats must not be empty", http.StatusBadRequest)
+		return
+	}
+	if len(req.Chats) > maxHistoryBatchChats {
+		http.Error(w, fmt.Sprintf("at most %d chats can be fetched at once", maxHistoryBatchChats), http.StatusBadRequest)
+		return
+	}
+	if req.Limit < 0 {
+		http.Error(w, "limit must not be negative", http.StatusBadRequest)
+		return
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = 10
+	}
+
+	histories, err := getChatHistories(req.Chats, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve messages: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, histories)
+}
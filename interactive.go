@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// WhatsApp clients show at most 3 quick-reply buttons and 10 list rows.
+const (
+	maxButtons  = 3
+	maxListRows = 10
+)
+
+// ReplyButton is a quick-reply button. The ID comes back in the
+// "button_reply" the user's selection produces.
+type ReplyButton struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// ListRow is a selectable row of a list message.
+type ListRow struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+}
+
+// ListSection groups rows of a list message under an optional title.
+type ListSection struct {
+	Title string    `json:"title,omitempty"`
+	Rows  []ListRow `json:"rows"`
+}
+
+// SendButtonsRequest is the body of POST /api/send/buttons. With AsText the
+// buttons are sent as a numbered plain-text menu instead, for recipients
+// whose clients don't show buttons.
+type SendButtonsRequest struct {
+	JID     string        `json:"jid"`
+	Message string        `json:"message"`
+	Footer  string        `json:"footer,omitempty"`
+	Buttons []ReplyButton `json:"buttons"`
+	AsText  bool          `json:"asText,omitempty"`
+}
+
+// SendListRequest is the body of POST /api/send/list. ButtonText is the label
+// of the button that opens the list. AsText works as for buttons.
+type SendListRequest struct {
+	JID        string        `json:"jid"`
+	Title      string        `json:"title,omitempty"`
+	Message    string        `json:"message"`
+	Footer     string        `json:"footer,omitempty"`
+	ButtonText string        `json:"buttonText"`
+	Sections   []ListSection `json:"sections"`
+	AsText     bool          `json:"asText,omitempty"`
+}
+
+// buildButtonsMessage builds a ButtonsMessage with quick-reply buttons, or
+// its text menu.
+func buildButtonsMessage(req SendButtonsRequest) (*waProto.Message, error) {
+	if strings.TrimSpace(req.Message) == "" {
+		return nil, fmt.Errorf("%w: message is required", errInvalidMessage)
+	}
+	if len(req.Buttons) == 0 || len(req.Buttons) > maxButtons {
+		return nil, fmt.Errorf("%w: between 1 and %d buttons are required", errInvalidMessage, maxButtons)
+	}
+	seen := make(map[string]bool, len(req.Buttons))
+	buttons := make([]*waProto.ButtonsMessage_Button, 0, len(req.Buttons))
+	for _, button := range req.Buttons {
+		if button.ID == "" || strings.TrimSpace(button.Text) == "" {
+			return nil, fmt.Errorf("%w: every button needs an id and text", errInvalidMessage)
+		}
+		if seen[button.ID] {
+			return nil, fmt.Errorf("%w: duplicate button id %q", errInvalidMessage, button.ID)
+		}
+		seen[button.ID] = true
+		buttons = append(buttons, &waProto.ButtonsMessage_Button{
+			ButtonID:   proto.String(button.ID),
+			ButtonText: &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(button.Text)},
+			Type:       waProto.ButtonsMessage_Button_RESPONSE.Enum(),
+		})
+	}
+	if req.AsText {
+		choices := make([]string, len(req.Buttons))
+		for i, button := range req.Buttons {
+			choices[i] = button.Text
+		}
+		return textMenu("", req.Message, req.Footer, choices), nil
+	}
+	msg := &waProto.ButtonsMessage{
+		ContentText: proto.String(req.Message),
+		Buttons:     buttons,
+		HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
+	}
+	if req.Footer != "" {
+		msg.FooterText = proto.String(req.Footer)
+	}
+	return &waProto.Message{ButtonsMessage: msg}, nil
+}
+
+// buildListMessage builds a single-select ListMessage, or its text menu.
+func buildListMessage(req SendListRequest) (*waProto.Message, error) {
+	if strings.TrimSpace(req.Message) == "" {
+		return nil, fmt.Errorf("%w: message is required", errInvalidMessage)
+	}
+	if strings.TrimSpace(req.ButtonText) == "" && !req.AsText {
+		return nil, fmt.Errorf("%w: buttonText is required", errInvalidMessage)
+	}
+	if len(req.Sections) == 0 {
+		return nil, fmt.Errorf("%w: at least one section is required", errInvalidMessage)
+	}
+	seen := make(map[string]bool)
+	var choices []string
+	sections := make([]*waProto.ListMessage_Section, 0, len(req.Sections))
+	for _, section := range req.Sections {
+		if len(section.Rows) == 0 {
+			return nil, fmt.Errorf("%w: every section needs at least one row", errInvalidMessage)
+		}
+		if len(req.Sections) > 1 && section.Title == "" {
+			return nil, fmt.Errorf("%w: sections need a title when there are several", errInvalidMessage)
+		}
+		rows := make([]*waProto.ListMessage_Row, 0, len(section.Rows))
+		for _, row := range section.Rows {
+			if row.ID == "" || strings.TrimSpace(row.Title) == "" {
+				return nil, fmt.Errorf("%w: every row needs an id and title", errInvalidMessage)
+			}
+			if seen[row.ID] {
+				return nil, fmt.Errorf("%w: duplicate row id %q", errInvalidMessage, row.ID)
+			}
+			seen[row.ID] = true
+			rows = append(rows, &waProto.ListMessage_Row{
+				RowID:       proto.String(row.ID),
+				Title:       proto.String(row.Title),
+				Description: proto.String(row.Description),
+			})
+			choice := row.Title
+			if row.Description != "" {
+				choice += " - " + row.Description
+			}
+			choices = append(choices, choice)
+		}
+		sections = append(sections, &waProto.ListMessage_Section{
+			Title: proto.String(section.Title),
+			Rows:  rows,
+		})
+	}
+	if len(choices) > maxListRows {
+		return nil, fmt.Errorf("%w: a list can have at most %d rows", errInvalidMessage, maxListRows)
+	}
+	if req.AsText {
+		return textMenu(req.Title, req.Message, req.Footer, choices), nil
+	}
+	return &waProto.Message{ListMessage: &waProto.ListMessage{
+		Title:       proto.String(req.Title),
+		Description: proto.String(req.Message),
+		ButtonText:  proto.String(req.ButtonText),
+		ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
+		Sections:    sections,
+		FooterText:  proto.String(req.Footer),
+	}}, nil
+}
+
+// textMenu renders choices as a numbered plain-text menu, which every client
+// shows. Users answer with the number, which arrives as a regular text.
+func textMenu(title, body, footer string, choices []string) *waProto.Message {
+	var sb strings.Builder
+	if title != "" {
+		sb.WriteString("*" + title + "*\n")
+	}
+	sb.WriteString(body + "\n")
+	for i, choice := range choices {
+		sb.WriteString("\n" + strconv.Itoa(i+1) + ". " + choice)
+	}
+	if footer != "" {
+		sb.WriteString("\n\n_" + footer + "_")
+	}
+	return &waProto.Message{Conversation: proto.String(sb.String())}
+}
+
+func handleSendButtons(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SendButtonsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok || !allowSend(w, jid) {
+		return
+	}
+	msg, err := buildButtonsMessage(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	resp, err := sess.sendMessage(ctx, jid, msg)
+	if err != nil {
+		writeOperationError(w, "Failed to send buttons", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSendResult(jid, resp))
+}
+
+func handleSendList(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SendListRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok || !allowSend(w, jid) {
+		return
+	}
+	msg, err := buildListMessage(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	resp, err := sess.sendMessage(ctx, jid, msg)
+	if err != nil {
+		writeOperationError(w, "Failed to send list", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSendResult(jid, resp))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBuildButtonsMessage(t *testing.T) {
+	yes := ReplyButton{ID: "yes", Text: "Yes"}
+	no := ReplyButton{ID: "no", Text: "No"}
+	tests := []struct {
+		name    string
+		req     SendButtonsRequest
+		wantErr bool
+	}{
+		{name: "valid", req: SendButtonsRequest{Message: "Continue?", Buttons: []ReplyButton{yes, no}}},
+		{name: "missing message", req: SendButtonsRequest{Message: " ", Buttons: []ReplyButton{yes}}, wantErr: true},
+		{name: "no buttons", req: SendButtonsRequest{Message: "Continue?"}, wantErr: true},
+		{name: "too many buttons", req: SendButtonsRequest{Message: "Continue?", Buttons: []ReplyButton{yes, no, {ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}, wantErr: true},
+		{name: "button without id", req: SendButtonsRequest{Message: "Continue?", Buttons: []ReplyButton{{Text: "Yes"}}}, wantErr: true},
+		{name: "button without text", req: SendButtonsRequest{Message: "Continue?", Buttons: []ReplyButton{{ID: "yes", Text: " "}}}, wantErr: true},
+		{name: "duplicate id", req: SendButtonsRequest{Message: "Continue?", Buttons: []ReplyButton{yes, {ID: "yes", Text: "Sure"}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := buildButtonsMessage(tt.req)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidMessage) {
+					t.Fatalf("err = %v, want errInvalidMessage", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(msg.GetButtonsMessage().GetButtons()); got != len(tt.req.Buttons) {
+				t.Errorf("message has %d buttons, want %d", got, len(tt.req.Buttons))
+			}
+		})
+	}
+}
+
+func TestBuildListMessage(t *testing.T) {
+	rows := func(ids ...string) []ListRow {
+		var r []ListRow
+		for _, id := range ids {
+			r = append(r, ListRow{ID: id, Title: "Row " + id})
+		}
+		return r
+	}
+	tests := []struct {
+		name    string
+		req     SendListRequest
+		wantErr bool
+	}{
+		{name: "valid", req: SendListRequest{Message: "Pick one", ButtonText: "Open", Sections: []ListSection{{Rows: rows("1", "2")}}}},
+		{name: "text menu needs no button text", req: SendListRequest{Message: "Pick one", AsText: true, Sections: []ListSection{{Rows: rows("1")}}}},
+		{name: "missing message", req: SendListRequest{ButtonText: "Open", Sections: []ListSection{{Rows: rows("1")}}}, wantErr: true},
+		{name: "missing button text", req: SendListRequest{Message: "Pick one", Sections: []ListSection{{Rows: rows("1")}}}, wantErr: true},
+		{name: "no sections", req: SendListRequest{Message: "Pick one", ButtonText: "Open"}, wantErr: true},
+		{name: "empty section", req: SendListRequest{Message: "Pick one", ButtonText: "Open", Sections: []ListSection{{}}}, wantErr: true},
+		{name: "untitled section among several", req: SendListRequest{Message: "Pick one", ButtonText: "Open", Sections: []ListSection{{Title: "A", Rows: rows("1")}, {Rows: rows("2")}}}, wantErr: true},
+		{name: "row without title", req: SendListRequest{Message: "Pick one", ButtonText: "Open", Sections: []ListSection{{Rows: []ListRow{{ID: "1"}}}}}, wantErr: true},
+		{name: "duplicate id across sections", req: SendListRequest{Message: "Pick one", ButtonText: "Open", Sections: []ListSection{{Title: "A", Rows: rows("1")}, {Title: "B", Rows: rows("1")}}}, wantErr: true},
+		{name: "too many rows", req: SendListRequest{Message: "Pick one", ButtonText: "Open", Sections: []ListSection{{Title: "A", Rows: rows("1", "2", "3", "4", "5", "6")}, {Title: "B", Rows: rows("7", "8", "9", "10", "11")}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := buildListMessage(tt.req)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidMessage) {
+					t.Fatalf("err = %v, want errInvalidMessage", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.req.AsText {
+				if msg.GetConversation() == "" {
+					t.Error("text menu is empty")
+				}
+			} else if msg.GetListMessage() == nil {
+				t.Error("no list message built")
+			}
+		})
+	}
+}
+
+func TestTextMenu(t *testing.T) {
+	tests := []struct {
+		name                string
+		title, body, footer string
+		choices             []string
+		want                string
+	}{
+		{
+			name:    "body and choices",
+			body:    "Continue?",
+			choices: []string{"Yes", "No"},
+			want:    "Continue?\n\n1. Yes\n2. No",
+		},
+		{
+			name:    "title and footer",
+			title:   "Menu",
+			body:    "Pick one",
+			footer:  "Reply with a number",
+			choices: []string{"Pizza - with cheese"},
+			want:    "*Menu*\nPick one\n\n1. Pizza - with cheese\n\n_Reply with a number_",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := textMenu(tt.title, tt.body, tt.footer, tt.choices).GetConversation(); got != tt.want {
+				t.Errorf("textMenu() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	// buildButtonsMessage falls back to the same menu
+	msg, err := buildButtonsMessage(SendButtonsRequest{Message: "Continue?", AsText: true, Buttons: []ReplyButton{{ID: "y", Text: "Yes"}, {ID: "n", Text: "No"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.GetConversation(); got != tests[0].want {
+		t.Errorf("buttons as text = %q, want %q", got, tests[0].want)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Package-level loggers, one per area. They discard output until setupLogging runs.
+var (
+	log      waLog.Logger = waLog.Noop
+	dbLog    waLog.Logger = waLog.Noop
+	eventLog waLog.Logger = waLog.Noop
+	agentLog waLog.Logger = waLog.Noop
+	apiLog   waLog.Logger = waLog.Noop
+	httpLog  waLog.Logger = waLog.Noop
+
+	logLevel  = "INFO"
+	logAsJSON bool
+	// logMessageBodies allows message contents in logs. Off by default so
+	// private message text never reaches centralized log storage.
+	logMessageBodies bool
+)
+
+// setupLogging configures the loggers from LOG_LEVEL (DEBUG, INFO, WARN or
+// ERROR), LOG_FORMAT ("json" for one JSON object per line, anything else
+// for human-readable output) and LOG_MESSAGE_BODIES. The HTTP access log has
+// its own level, HTTP_LOG_LEVEL, defaulting to LOG_LEVEL.
+func setupLogging() {
+	var invalidLevels []string
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		if level, ok := parseLogLevel(raw); ok {
+			logLevel = level
+		} else {
+			invalidLevels = append(invalidLevels, "LOG_LEVEL="+raw)
+		}
+	}
+	logAsJSON = strings.EqualFold(os.Getenv("LOG_FORMAT"), "json")
+	logMessageBodies, _ = strconv.ParseBool(os.Getenv("LOG_MESSAGE_BODIES"))
+
+	log = newLogger("Main")
+	dbLog = newLogger("Database")
+	eventLog = newLogger("Events")
+	agentLog = newLogger("Agent")
+	apiLog = newLogger("API")
+
+	httpLogLevel := logLevel
+	if raw := os.Getenv("HTTP_LOG_LEVEL"); raw != "" {
+		if level, ok := parseLogLevel(raw); ok {
+			httpLogLevel = level
+		} else {
+			invalidLevels = append(invalidLevels, "HTTP_LOG_LEVEL="+raw)
+		}
+	}
+	httpLog = newLoggerAt("HTTP", httpLogLevel)
+
+	for _, setting := range invalidLevels {
+		log.Warnf("Invalid log level %s, expected DEBUG, INFO, WARN or ERROR; using %s", setting, logLevel)
+	}
+}
+
+// parseLogLevel normalizes a log level name, accepting any case and WARNING
+// for WARN. Unknown levels are rejected: waLog would otherwise treat them as
+// the lowest level and log everything, including DEBUG output.
+func parseLogLevel(raw string) (string, bool) {
+	switch level := strings.ToUpper(strings.TrimSpace(raw)); level {
+	case "DEBUG", "INFO", "WARN", "ERROR":
+		return level, true
+	case "WARNING":
+		return "WARN", true
+	}
+	return "", false
+}
+
+// newLogger creates a logger for a module using the configured level and format.
+func newLogger(module string) waLog.Logger {
+	return newLoggerAt(module, logLevel)
+}
+
+// newLoggerAt creates a logger for a module with its own minimum level.
+func newLoggerAt(module, minLevel string) waLog.Logger {
+	if !logAsJSON {
+		return waLog.Stdout(module, minLevel, true)
+	}
+	level, err := zerolog.ParseLevel(strings.ToLower(minLevel))
+	if err != nil {
+		level = zerolog.InfoLevel
+	}
+	return waLog.Zerolog(zerolog.New(os.Stdout).Level(level).With().Timestamp().Str("module", module).Logger())
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// startQRLogin connects a client that has no session and pushes the pairing
+// QR codes to the agent in the background until pairing succeeds or times out.
+func (s *Session) startQRLogin() error {
+	qrChan, err := s.client.GetQRChannel(context.Background())
+	if err != nil {
+		return err
+	}
+	if err := s.client.Connect(); err != nil {
+		return err
+	}
+	go s.pushQRCodes(qrChan)
+	return nil
+}
+
+// pushQRCodes pushes each pairing code to the agent and keeps the latest one
+// for GET /api/qr until the login finishes.
+func (s *Session) pushQRCodes(qrChan <-chan whatsmeow.QRChannelItem) {
+	for qr := range qrChan {
+		if qr.Event != whatsmeow.QRChannelEventCode {
+			s.qrCode.Store("")
+			log.Infof("QR login finished: %s", qr.Event)
+			continue
+		}
+		s.qrCode.Store(qr.Code)
+		log.Infof("QR code string received. Pushing to agent at %s/api/qr", agentBaseURL)
+		if err := postJSON(agentBaseURL+"/api/qr", map[string]string{"qr": qr.Code}); err != nil {
+			agentLog.Errorf("Failed to push QR code to agent: %v", err)
+		}
+	}
+}
+
+// handleLoggedOut reacts to the account removing this device (or WhatsApp
+// refusing the session): the agent is told why, the local session is
+// cleared and a new QR pairing is started so the operator can re-pair
+// without a restart.
+func (s *Session) handleLoggedOut(v *events.LoggedOut) {
+	sessionID := s.ID()
+	s.setJID(types.EmptyJID, types.EmptyJID)
+	// Logged out sessions must pair again, retrying won't help
+	s.stopReconnect()
+	s.presenceSubscriptions.Clear()
+	log.Warnf("Session %s was logged out: %s", sessionID, v.Reason)
+	s.postStatus(map[string]string{
+		"status":  "logged_out",
+		"session": sessionID,
+		"reason":  v.Reason.String(),
+	})
+
+	// The event is dispatched while whatsmeow is still tearing the
+	// connection down, so re-pair from a separate goroutine
+	go func() {
+		s.loginMu.Lock()
+		defer s.loginMu.Unlock()
+		s.client.Disconnect()
+		// whatsmeow deletes the session itself; this covers a failed delete
+		if s.client.Store.ID != nil {
+			if err := s.client.Store.Delete(context.Background()); err != nil {
+				log.Errorf("Failed to clear logged out session %s: %v", sessionID, err)
+				return
+			}
+		}
+		if err := s.startQRLogin(); err != nil {
+			log.Errorf("Failed to start QR login after logout: %v", err)
+			return
+		}
+		log.Infof("Waiting for a new QR pairing to replace session %s", sessionID)
+	}()
+}
+
+// handleLogin starts a new pairing without restarting the process, e.g. after
+// the device was logged out. QR codes are pushed to the agent's /api/qr.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	sess, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	sess.loginMu.Lock()
+	defer sess.loginMu.Unlock()
+	client := sess.client
+
+	switch {
+	case client.IsLoggedIn():
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "Already logged in"})
+		return
+	case client.IsConnected():
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "Login already in progress"})
+		return
+	case sess.ID() != "":
+		// A session exists but isn't connected, so reconnect instead of pairing again
+		if err := client.Connect(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to connect: " + err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "reconnecting"})
+		return
+	}
+
+	if err := sess.startQRLogin(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to start login: " + err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "qr_pending"})
+}
+
+// currentQRCode returns the pairing code of a QR login in progress, or "".
+func (s *Session) currentQRCode() string {
+	code, _ := s.qrCode.Load().(string)
+	return code
+}
+
+// handleGetQR returns the current pairing code, for operators who pair
+// without the agent's /api/qr webhook.
+func handleGetQR(w http.ResponseWriter, r *http.Request) {
+	sess, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if sess.client.IsLoggedIn() {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "Already logged in"})
+		return
+	}
+	code := sess.currentQRCode()
+	if code == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "No pairing in progress, use POST /api/login to start one"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"qr": code})
+}
+
+// logout unregisters the session's device from the WhatsApp account and
+// tells the agent. whatsmeow removes the session from the device store on
+// success; with force the local session is also cleared when the
+// server-side logout fails, e.g. because the device was already removed from
+// the phone, and the failure is returned as a warning. The caller holds
+// loginMu.
+func (s *Session) logout(ctx context.Context, force bool) (warning string, err error) {
+	client := s.client
+	sessionID := s.ID()
+	s.stopReconnect()
+	if err := client.Logout(ctx); err != nil {
+		if !force {
+			return "", err
+		}
+		log.Warnf("Logout failed, clearing local session anyway: %v", err)
+		client.Disconnect()
+		if err := client.Store.Delete(ctx); err != nil {
+			return "", fmt.Errorf("failed to clear local session: %w", err)
+		}
+		warning = "Server-side logout failed, only the local session was cleared: " + err.Error()
+	}
+	s.setJID(types.EmptyJID, types.EmptyJID)
+	s.presenceSubscriptions.Clear()
+	s.postStatus(map[string]string{"status": "logged_out", "session": sessionID})
+	return warning, nil
+}
+
+// handleLogout logs the session out (see logout; force=true clears the local
+// session even if WhatsApp can't be reached) and starts a new QR pairing.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	sess, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	sess.loginMu.Lock()
+	defer sess.loginMu.Unlock()
+
+	// Reject new sends while the store is being torn down
+	sess.loggingOut.Store(true)
+	defer sess.loggingOut.Store(false)
+
+	if sess.ID() == "" {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "Not logged in"})
+		return
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	warning, err := sess.logout(r.Context(), force)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to log out: " + err.Error()})
+		return
+	}
+	result := map[string]interface{}{"status": "logged_out"}
+	if warning != "" {
+		result["warning"] = warning
+	}
+	// Start pairing again right away so GET /api/qr has a fresh code
+	if err := sess.startQRLogin(); err != nil {
+		log.Warnf("Logged out, but failed to start a new QR login: %v", err)
+		result["warning"] = "Failed to start a new QR login, use POST /api/login: " + err.Error()
+	} else {
+		log.Infof("Logged out, waiting for a new QR pairing")
+	}
+	writeJSON(w, http.StatusOK, result)
+}
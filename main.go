@@ -1,198 +1,685 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mau.fi/whatsmeow"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
-	waLog "go.mau.fi/whatsmeow/util/log"
 	"google.golang.org/protobuf/proto"
 )
 
 var (
-	client       *whatsmeow.Client
-	container    *sqlstore.Container
-	db           *sql.DB
-	agentBaseURL string
+	container     *sqlstore.Container
+	db            *database
+	agentBaseURL  string
 	serverBaseURL string
-	serverPort   string
-	mediaMap     sync.Map
-	startTime    time.Time
+	serverPort    string
+	mediaMap      *mediaCache
+	startTime     time.Time
+	displayLoc    *time.Location
+	sendDelay     time.Duration
+	// historyContextSize is the number of recent chat messages attached to
+	// messages forwarded to the agent; 0 disables history.
+	historyContextSize int
+	// sendTimeout and downloadTimeout bound WhatsApp operations made on
+	// behalf of API requests.
+	sendTimeout     time.Duration
+	downloadTimeout time.Duration
+	// inlineMediaMaxBytes is the largest media file sent to the agent inline
+	// as base64; 0 disables inlining.
+	inlineMediaMaxBytes uint64
+	// mediaDir is where downloaded media is kept (MEDIA_DIR); empty keeps
+	// nothing.
+	mediaDir string
+	// maxMediaBytes is the largest media file the server downloads; 0 means
+	// no limit.
+	maxMediaBytes uint64
 )
 
 type MessageContent struct {
-	Type        string `json:"type"`
-	Body        string `json:"body,omitempty"`
-	Caption     string `json:"caption,omitempty"`
-	Mimetype    string `json:"mimetype,omitempty"`
-	DownloadURL string `json:"downloadURL,omitempty"`
+	Type            string           `json:"type"`
+	Body            string           `json:"body,omitempty"`
+	Caption         string           `json:"caption,omitempty"`
+	Mimetype        string           `json:"mimetype,omitempty"`
+	DownloadURL     string           `json:"downloadURL,omitempty"`
+	Data            string           `json:"data,omitempty"`
+	TargetMessageID string           `json:"targetMessageID,omitempty"`
+	Location        *LocationContent `json:"location,omitempty"`
+	Poll            *PollContent     `json:"poll,omitempty"`
+	PreviousBody    string           `json:"previousBody,omitempty"`
+	QuotedMessageID string           `json:"quotedMessageID,omitempty"`
+	// SelectedID is the button or list row ID of a "button_reply"; Body
+	// carries its display text.
+	SelectedID string `json:"selectedID,omitempty"`
+	// ExpirationSeconds is set for disappearing messages, and for a
+	// "disappearing_timer" event is the chat's new timer (0 turns it off).
+	ExpirationSeconds uint32   `json:"expirationSeconds,omitempty"`
+	MentionedJIDs     []string `json:"mentionedJIDs,omitempty"`
+}
+
+// LocationContent carries the coordinates of a location message. For live
+// locations only the initial point is reported.
+type LocationContent struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+	Live      bool    `json:"live,omitempty"`
 }
 
 type AgentMessage struct {
-	MessageID string         `json:"messageID"`
-	Timestamp time.Time      `json:"timestamp"`
-	SenderJID string         `json:"senderJID"`
-	ChatJID   string         `json:"chatJID"`
-	IsGroup   bool           `json:"isGroup"`
-	IsFromMe  bool           `json:"isFromMe"`
-	Content   MessageContent `json:"content"`
+	SessionID  string         `json:"sessionID,omitempty"`
+	MessageID  string         `json:"messageID"`
+	Timestamp  time.Time      `json:"timestamp"`
+	SenderJID  string         `json:"senderJID"`
+	SenderName string         `json:"senderName"`
+	ChatJID    string         `json:"chatJID"`
+	IsGroup    bool           `json:"isGroup"`
+	IsFromMe   bool           `json:"isFromMe"`
+	Content    MessageContent `json:"content"`
+	ReplyTo    *ReplyContext  `json:"replyTo,omitempty"`
+}
+
+// ReplyContext identifies the message an incoming message replies to. Preview
+// is empty when neither the reply nor our database has the quoted content.
+type ReplyContext struct {
+	MessageID string `json:"messageID"`
+	SenderJID string `json:"senderJID,omitempty"`
+	Preview   string `json:"preview,omitempty"`
 }
 
+// replyPreviewLength caps the quoted text included in a ReplyContext.
+const replyPreviewLength = 200
+
+// SendMessageRequest is the body of POST /api/send. Type selects the kind of
+// message ("text" by default); the remaining fields are used by the types
+// that need them.
 type SendMessageRequest struct {
-	JID     string `json:"jid"`
-	Message string `json:"message"`
+	JID        string   `json:"jid"`
+	Recipients []string `json:"recipients,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	Message    string   `json:"message"`
+	Mentions   []string `json:"mentions,omitempty"`
+	// ExpirationSeconds makes the message disappear after 24 hours (86400),
+	// 7 days (604800) or 90 days (7776000).
+	ExpirationSeconds uint32 `json:"expirationSeconds,omitempty"`
+
+	// Media (sticker), base64-encoded
+	Data string `json:"data,omitempty"`
+
+	// Location
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Address   string   `json:"address,omitempty"`
+
+	// Contact
+	DisplayName  string `json:"displayName,omitempty"`
+	VCard        string `json:"vcard,omitempty"`
+	Phone        string `json:"phone,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Email        string `json:"email,omitempty"`
+
+	// Poll
+	Question        string   `json:"question,omitempty"`
+	Options         []string `json:"options,omitempty"`
+	SelectableCount int      `json:"selectableCount,omitempty"`
+
+	// Buttons and list, with Message as the body
+	Title      string        `json:"title,omitempty"`
+	Footer     string        `json:"footer,omitempty"`
+	Buttons    []ReplyButton `json:"buttons,omitempty"`
+	ButtonText string        `json:"buttonText,omitempty"`
+	Sections   []ListSection `json:"sections,omitempty"`
+	AsText     bool          `json:"asText,omitempty"`
+}
+
+// SendLocationRequest is the body of POST /api/send/location.
+type SendLocationRequest struct {
+	JID       string  `json:"jid"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
 }
 
-func eventHandler(evt interface{}) {
+// SendContactRequest is the body of POST /api/send/contact. Either a full
+// VCard is given, or one is assembled from the structured fields.
+type SendContactRequest struct {
+	JID          string `json:"jid"`
+	DisplayName  string `json:"displayName"`
+	VCard        string `json:"vcard,omitempty"`
+	Phone        string `json:"phone,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Email        string `json:"email,omitempty"`
+}
+
+// SendResult reports the outcome of a send to a single recipient. Timestamp
+// is the server timestamp WhatsApp assigned to the message.
+type SendResult struct {
+	JID           string `json:"jid"`
+	MessageID     string `json:"messageID,omitempty"`
+	Timestamp     string `json:"timestamp,omitempty"`
+	TimestampUnix int64  `json:"timestampUnix,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// newSendResult builds the result for a successful send to jid.
+func newSendResult(jid types.JID, resp whatsmeow.SendResponse) SendResult {
+	return SendResult{
+		JID:           jid.String(),
+		MessageID:     resp.ID,
+		Timestamp:     resp.Timestamp.UTC().Format(time.RFC3339),
+		TimestampUnix: resp.Timestamp.Unix(),
+	}
+}
+
+func (s *Session) handleEvent(evt interface{}) {
 	switch v := evt.(type) {
 	case *events.Connected:
-		fmt.Println("✅ Login successful")
-		if client != nil && client.Store != nil && client.Store.ID != nil {
-			fmt.Printf("📱 Device JID: %s\n", client.Store.ID.String())
-			fmt.Println("💾 Device data will be persisted automatically")
+		s.stopReconnect()
+		s.lastConnected.Store(time.Now().Unix())
+		eventLog.Infof("Login successful")
+		if id := s.client.Store.ID; id != nil {
+			s.setJID(*id, s.client.Store.LID)
+			eventLog.Infof("Device JID: %s", id.String())
+			eventLog.Infof("Device data will be persisted automatically")
 		}
-		postJSON(agentBaseURL+"/api/status", map[string]string{"status": "logged_in"})
+		s.postStatus(map[string]string{"status": "logged_in", "session": s.ID()})
+		// Presence subscriptions are tied to the connection
+		go s.resubscribePresence()
 	case *events.Disconnected:
-		fmt.Println("🔌 Disconnected")
-		postJSON(agentBaseURL+"/api/status", map[string]string{"status": "disconnected"})
+		eventLog.Warnf("Session %s disconnected", s.ID())
+		s.postStatus(map[string]string{"status": "disconnected", "session": s.ID()})
+		s.startReconnect()
+	case *events.StreamReplaced:
+		// Another client took over the connection; keep trying to get it back
+		eventLog.Warnf("Session %s was replaced by another connection", s.ID())
+		s.startReconnect()
+	case *events.KeepAliveTimeout:
+		// whatsmeow only forces a reconnect itself when its auto-reconnect is on
+		if time.Since(v.LastSuccess) > whatsmeow.KeepAliveMaxFailTime {
+			eventLog.Warnf("Session %s stopped answering keepalives, reconnecting", s.ID())
+			s.client.Disconnect()
+			s.startReconnect()
+		}
 	case *events.Message:
-		// Full event debug
-		fmt.Printf("DEBUG FULL EVENT: %+v\n", v)
-		// Raw message debug
-		fmt.Printf("DEBUG RAW MESSAGE: %+v\n", v.Message)
-
-		fmt.Printf("Message received: From=%s, IsGroup=%t\n", v.Info.Sender, v.Info.IsGroup)
-
-		isFromMe := false
-		if client != nil && client.Store != nil && client.Store.ID != nil {
-			// Check if the message sender is the logged-in user
-			isFromMe = v.Info.Sender.User == client.Store.ID.User
-		}
-
-		agentMsg := AgentMessage{
-			MessageID: v.Info.ID,
-			Timestamp: v.Info.Timestamp,
-			SenderJID: v.Info.Sender.String(),
-			ChatJID:   v.Info.Chat.String(),
-			IsGroup:   v.Info.IsGroup,
-			IsFromMe:  isFromMe,
-		}
-		msg := v.Message
-		// Improved extraction for all major WhatsApp message types
-		switch {
-		case msg.GetSenderKeyDistributionMessage() != nil:
-			fmt.Println("Ignoring sender key distribution message")
-			return // Ignore these technical messages
-		case msg.GetConversation() != "":
-			agentMsg.Content.Type = "text"
-			agentMsg.Content.Body = msg.GetConversation()
-		case msg.GetExtendedTextMessage() != nil && msg.GetExtendedTextMessage().GetText() != "":
-			agentMsg.Content.Type = "text"
-			agentMsg.Content.Body = msg.GetExtendedTextMessage().GetText()
-		case msg.GetImageMessage() != nil:
-			agentMsg.Content.Type = "image"
-			agentMsg.Content.Caption = msg.GetImageMessage().GetCaption()
-			agentMsg.Content.Mimetype = msg.GetImageMessage().GetMimetype()
-			agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
-			mediaMap.Store(v.Info.ID, msg.GetImageMessage())
-		case msg.GetVideoMessage() != nil:
-			agentMsg.Content.Type = "video"
-			agentMsg.Content.Caption = msg.GetVideoMessage().GetCaption()
-			agentMsg.Content.Mimetype = msg.GetVideoMessage().GetMimetype()
-			agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
-			mediaMap.Store(v.Info.ID, msg.GetVideoMessage())
-		case msg.GetDocumentMessage() != nil:
-			agentMsg.Content.Type = "document"
-			agentMsg.Content.Caption = msg.GetDocumentMessage().GetCaption()
-			agentMsg.Content.Mimetype = msg.GetDocumentMessage().GetMimetype()
-			agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
-			mediaMap.Store(v.Info.ID, msg.GetDocumentMessage())
-		case msg.GetAudioMessage() != nil:
-			agentMsg.Content.Type = "audio"
-			agentMsg.Content.Mimetype = msg.GetAudioMessage().GetMimetype()
-			agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
-			mediaMap.Store(v.Info.ID, msg.GetAudioMessage())
-		case msg.GetStickerMessage() != nil:
-			agentMsg.Content.Type = "sticker"
-			agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
-			mediaMap.Store(v.Info.ID, msg.GetStickerMessage())
-		case msg.GetContactMessage() != nil:
-			agentMsg.Content.Type = "contact"
-			agentMsg.Content.Body = msg.GetContactMessage().GetDisplayName()
-		case msg.GetButtonsMessage() != nil:
-			agentMsg.Content.Type = "buttons"
-			agentMsg.Content.Body = msg.GetButtonsMessage().GetContentText()
-		case msg.GetListMessage() != nil:
-			agentMsg.Content.Type = "list"
-			agentMsg.Content.Body = msg.GetListMessage().GetDescription()
-		default:
-			agentMsg.Content.Type = "unsupported"
-			agentMsg.Content.Body = "Message type not supported by PoC server."
-		}
-
-		// Attach chat history (last 10 messages, sorted chronologically)
-		history, err := getRecentChatHistory(v.Info.Chat.String(), 10)
+		s.dispatcher.Dispatch(v)
+	case *events.PairSuccess:
+		s.setJID(v.ID, v.LID)
+	case *events.LoggedOut:
+		s.handleLoggedOut(v)
+	case *events.Receipt:
+		// Queued behind the chat's messages, so a receipt can't overtake the
+		// message it acknowledges
+		s.dispatcher.Run(v.Chat.String(), func() { s.handleReceipt(v) })
+	case *events.GroupInfo:
+		s.dispatcher.Run(v.JID.String(), func() { s.handleGroupInfo(v) })
+	case *events.JoinedGroup:
+		s.dispatcher.Run(v.JID.String(), func() { s.handleJoinedGroup(v) })
+	case *events.Presence:
+		s.dispatcher.Run(v.From.ToNonAD().String(), func() { s.handlePresence(v) })
+	}
+}
+
+// handleMessage converts an incoming message for the agent, forwards it along
+// with recent chat history, and stores it. It runs on the message dispatcher's
+// workers rather than on the whatsmeow event goroutine.
+func (s *Session) handleMessage(v *events.Message) {
+	// Full event dumps include message bodies, so they need an explicit opt-in
+	if logMessageBodies {
+		eventLog.Debugf("Full event: %+v", v)
+		eventLog.Debugf("Raw message: %+v", v.Message)
+	}
+
+	// Check if the message sender is the logged-in user
+	isFromMe := s.ownsUser(v.Info.Sender.User)
+
+	senderName := resolveContactName(v.Info.Sender)
+	if senderName == v.Info.Sender.User && v.Info.PushName != "" {
+		senderName = v.Info.PushName
+		rememberPushName(v.Info.Sender, v.Info.PushName)
+	}
+
+	agentMsg := AgentMessage{
+		SessionID:  s.ID(),
+		MessageID:  v.Info.ID,
+		Timestamp:  v.Info.Timestamp,
+		SenderJID:  v.Info.Sender.String(),
+		SenderName: senderName,
+		ChatJID:    v.Info.Chat.String(),
+		IsGroup:    v.Info.IsGroup,
+		IsFromMe:   isFromMe,
+	}
+	msg := v.Message
+
+	// Edits arrive as a protocol message pointing at the original message
+	if protoMsg := msg.GetProtocolMessage(); protoMsg != nil && protoMsg.GetType() == waProto.ProtocolMessage_MESSAGE_EDIT {
+		handleMessageEdit(agentMsg, v.Info, protoMsg)
+		return
+	}
+	// Deletions for everyone arrive as a revoke protocol message
+	if protoMsg := msg.GetProtocolMessage(); protoMsg != nil && protoMsg.GetType() == waProto.ProtocolMessage_REVOKE {
+		s.handleMessageRevoke(agentMsg, v.Info, protoMsg)
+		return
+	}
+	if protoMsg := msg.GetProtocolMessage(); protoMsg != nil && protoMsg.GetType() == waProto.ProtocolMessage_EPHEMERAL_SETTING {
+		handleDisappearingTimer(agentMsg, protoMsg)
+		return
+	}
+
+	// Improved extraction for all major WhatsApp message types
+	switch {
+	case msg.GetSenderKeyDistributionMessage() != nil:
+		eventLog.Debugf("Ignoring sender key distribution message %s", v.Info.ID)
+		return // Ignore these technical messages
+	case msg.GetConversation() != "":
+		agentMsg.Content.Type = "text"
+		agentMsg.Content.Body = msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil && msg.GetExtendedTextMessage().GetText() != "":
+		agentMsg.Content.Type = "text"
+		agentMsg.Content.Body = msg.GetExtendedTextMessage().GetText()
+		// Context info is nil for plain texts; the getters below are nil-safe
+		contextInfo := msg.GetExtendedTextMessage().GetContextInfo()
+		agentMsg.Content.QuotedMessageID = contextInfo.GetStanzaID()
+		agentMsg.Content.MentionedJIDs = contextInfo.GetMentionedJID()
+	case msg.GetReactionMessage() != nil:
+		agentMsg.Content.Type = "reaction"
+		agentMsg.Content.Body = msg.GetReactionMessage().GetText()
+		agentMsg.Content.TargetMessageID = msg.GetReactionMessage().GetKey().GetID()
+	case msg.GetImageMessage() != nil:
+		agentMsg.Content.Type = "image"
+		agentMsg.Content.Caption = msg.GetImageMessage().GetCaption()
+		agentMsg.Content.Mimetype = msg.GetImageMessage().GetMimetype()
+		agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
+		mediaMap.Store(v.Info.ID, msg.GetImageMessage())
+	case msg.GetVideoMessage() != nil:
+		agentMsg.Content.Type = "video"
+		agentMsg.Content.Caption = msg.GetVideoMessage().GetCaption()
+		agentMsg.Content.Mimetype = msg.GetVideoMessage().GetMimetype()
+		agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
+		mediaMap.Store(v.Info.ID, msg.GetVideoMessage())
+	case msg.GetDocumentMessage() != nil:
+		agentMsg.Content.Type = "document"
+		agentMsg.Content.Caption = msg.GetDocumentMessage().GetCaption()
+		agentMsg.Content.Mimetype = msg.GetDocumentMessage().GetMimetype()
+		agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
+		mediaMap.Store(v.Info.ID, msg.GetDocumentMessage())
+	case msg.GetAudioMessage() != nil:
+		agentMsg.Content.Type = "audio"
+		agentMsg.Content.Mimetype = msg.GetAudioMessage().GetMimetype()
+		agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
+		mediaMap.Store(v.Info.ID, msg.GetAudioMessage())
+	case msg.GetStickerMessage() != nil:
+		agentMsg.Content.Type = "sticker"
+		agentMsg.Content.DownloadURL = fmt.Sprintf("%s/api/download/%s", serverBaseURL, v.Info.ID)
+		mediaMap.Store(v.Info.ID, msg.GetStickerMessage())
+	case msg.GetLocationMessage() != nil:
+		loc := msg.GetLocationMessage()
+		agentMsg.Content.Type = "location"
+		agentMsg.Content.Location = &LocationContent{
+			Latitude:  loc.GetDegreesLatitude(),
+			Longitude: loc.GetDegreesLongitude(),
+			Name:      loc.GetName(),
+			Address:   loc.GetAddress(),
+		}
+	case msg.GetLiveLocationMessage() != nil:
+		loc := msg.GetLiveLocationMessage()
+		agentMsg.Content.Type = "location"
+		agentMsg.Content.Caption = loc.GetCaption()
+		agentMsg.Content.Location = &LocationContent{
+			Latitude:  loc.GetDegreesLatitude(),
+			Longitude: loc.GetDegreesLongitude(),
+			Live:      true,
+		}
+	case pollCreation(msg) != nil:
+		agentMsg.Content.Type = "poll"
+		agentMsg.Content.Poll = newPollContent(pollCreation(msg))
+	case msg.GetPollUpdateMessage() != nil:
+		agentMsg.Content.Type = "poll_vote"
+		agentMsg.Content.TargetMessageID = msg.GetPollUpdateMessage().GetPollCreationMessageKey().GetID()
+		poll, err := s.pollVote(v)
 		if err != nil {
-			fmt.Printf("Error fetching chat history: %v\n", err)
+			eventLog.Warnf("Failed to decrypt poll vote %s: %v", v.Info.ID, err)
+		} else {
+			forwardPollVote(agentMsg, poll)
 		}
+		agentMsg.Content.Poll = poll
+	case msg.GetContactMessage() != nil:
+		agentMsg.Content.Type = "contact"
+		agentMsg.Content.Body = msg.GetContactMessage().GetDisplayName()
+	case msg.GetButtonsMessage() != nil:
+		agentMsg.Content.Type = "buttons"
+		agentMsg.Content.Body = msg.GetButtonsMessage().GetContentText()
+	case msg.GetListMessage() != nil:
+		agentMsg.Content.Type = "list"
+		agentMsg.Content.Body = msg.GetListMessage().GetDescription()
+	case isButtonReply(msg):
+		agentMsg.Content.Type = "button_reply"
+		agentMsg.Content.SelectedID, agentMsg.Content.Body = buttonReply(msg)
+		// The message with the buttons or list the user answered
+		agentMsg.Content.TargetMessageID = messageContextInfo(msg).GetStanzaID()
+	default:
+		agentMsg.Content.Type = "unsupported"
+		agentMsg.Content.Body = "Message type not supported by PoC server."
+	}
 
-		// The history is already processed by getRecentChatHistory -> getMessages -> executeMessageQuery
-		// No further processing is needed here. The data is consistent.
-
-		payload := map[string]interface{}{
-			"message": agentMsg,
-			"history": history,
+	agentMsg.ReplyTo = replyContext(messageContextInfo(msg))
+	// whatsmeow has already unwrapped disappearing messages; keep their timer
+	if v.IsEphemeral {
+		agentMsg.Content.ExpirationSeconds = messageContextInfo(msg).GetExpiration()
+	}
+	if agentMsg.Content.DownloadURL != "" && inlineMediaMaxBytes > 0 {
+		if media, ok := mediaMap.Load(v.Info.ID); ok {
+			s.inlineMedia(&agentMsg.Content, media)
 		}
-		postJSON(agentBaseURL+"/api/message", payload)
+	}
 
-		// Store the message after processing
-		serializedMsg, err := proto.Marshal(v.Message)
+	eventLog.Infof("Message %s received from %s in %s (type: %s, group: %t)", v.Info.ID, v.Info.Sender, v.Info.Chat, agentMsg.Content.Type, v.Info.IsGroup)
+	messagesReceived.WithLabelValues(agentMsg.Content.Type).Inc()
+
+	// Store the message before reading history, so the history includes it
+	serializedMsg, err := proto.Marshal(v.Message)
+	if err != nil {
+		eventLog.Errorf("Failed to serialize message %s for storage: %v", v.Info.ID, err)
+	} else if err := messageWriter.Store(s.ID(), v.Info.ID, v.Info.Chat, v.Info.Sender, v.Info.IsFromMe, serializedMsg, v.Info.Timestamp); err != nil {
+		dbLog.Errorf("Failed to store message %s: %v", v.Info.ID, err)
+	}
+
+	payload := map[string]interface{}{
+		"message": agentMsg,
+	}
+	// Attach the last historyContextSize messages of the chat, sorted chronologically
+	if historyContextSize > 0 {
+		history, err := getRecentChatHistory(v.Info.Chat.String(), historyContextSize)
 		if err != nil {
-			fmt.Printf("Failed to serialize message for storage: %v\n", err)
-		} else {
-			// Using a goroutine to avoid blocking the event handler
-			go func() {
-				if err := storeMessage(v.Info.ID, v.Info.Chat, v.Info.Sender, serializedMsg, v.Info.Timestamp); err != nil {
-					fmt.Printf("Failed to store message: %v\n", err)
-				}
-			}()
+			dbLog.Errorf("Error fetching chat history: %v", err)
 		}
+		payload["history"] = history
 	}
+	forwardToAgent(payload)
+}
+
+// handleMessageEdit replaces the stored content of the edited message and
+// forwards an "edit" event with the old and new text to the agent. Edits of
+// messages that aren't stored in the chat, or were sent by someone else, are
+// dropped.
+func handleMessageEdit(agentMsg AgentMessage, info types.MessageInfo, protoMsg *waProto.ProtocolMessage) {
+	targetID := protoMsg.GetKey().GetID()
+	edited := protoMsg.GetEditedMessage()
+	chat, _ := types.ParseJID(agentMsg.ChatJID)
+
+	serializedMsg, err := proto.Marshal(edited)
+	if err != nil {
+		eventLog.Errorf("Failed to serialize edited message %s: %v", targetID, err)
+		return
+	}
+	previous, err := applyMessageEdit(targetID, chat, serializedMsg, agentMsg.Timestamp, info.Sender, info.SenderAlt)
+	if errors.Is(err, errMessageNotFound) || errors.Is(err, errNotMessageSender) {
+		eventLog.Warnf("Dropping edit of message %s by %s: %v", targetID, info.Sender, err)
+		return
+	} else if err != nil {
+		dbLog.Errorf("Failed to update edited message %s: %v", targetID, err)
+		return
+	}
+	eventLog.Infof("Message %s in %s was edited", targetID, agentMsg.ChatJID)
+	var previousMsg waProto.Message
+	if err := proto.Unmarshal(previous, &previousMsg); err == nil {
+		agentMsg.Content.PreviousBody = messageText(&previousMsg)
+	}
+
+	agentMsg.Content.Type = "edit"
+	messagesReceived.WithLabelValues(agentMsg.Content.Type).Inc()
+	agentMsg.Content.Body = messageText(edited)
+	agentMsg.Content.TargetMessageID = targetID
+	forwardToAgent(map[string]interface{}{
+		"message": agentMsg,
+	})
+}
+
+// handleMessageRevoke tombstones a message deleted for everyone and forwards a
+// "delete" event to the agent. Only the sender may delete a message, or in
+// groups an admin; other revokes, and revokes of messages that aren't stored
+// in the chat, are dropped.
+func (s *Session) handleMessageRevoke(agentMsg AgentMessage, info types.MessageInfo, protoMsg *waProto.ProtocolMessage) {
+	targetID := protoMsg.GetKey().GetID()
+	if err := s.checkRevoke(targetID, info); err != nil {
+		eventLog.Warnf("Dropping deletion of message %s by %s: %v", targetID, info.Sender, err)
+		return
+	}
+	if err := markMessageDeleted(targetID, info.Chat, agentMsg.Timestamp); errors.Is(err, errMessageNotFound) {
+		eventLog.Warnf("Dropping deletion of message %s by %s: %v", targetID, info.Sender, err)
+		return
+	} else if err != nil {
+		dbLog.Errorf("Failed to mark message %s as deleted: %v", targetID, err)
+		return
+	}
+	eventLog.Infof("Message %s in %s was deleted", targetID, agentMsg.ChatJID)
+	mediaMap.Delete(targetID)
+	removeSavedMedia(targetID)
+
+	agentMsg.Content.Type = "delete"
+	messagesReceived.WithLabelValues(agentMsg.Content.Type).Inc()
+	agentMsg.Content.TargetMessageID = targetID
+	forwardToAgent(map[string]interface{}{
+		"message": agentMsg,
+	})
+}
+
+// checkRevoke returns an error unless the revoke in info may delete message
+// msgID: the message must be stored in the revoke's chat, and the revoke must
+// come from its sender or, in groups, an admin.
+func (s *Session) checkRevoke(msgID string, info types.MessageInfo) error {
+	sender, err := storedSender(msgID, info.Chat)
+	if err != nil {
+		return err
+	}
+	if sentBy(sender, []types.JID{info.Sender, info.SenderAlt}) {
+		return nil
+	}
+	if info.Chat.Server != types.GroupServer {
+		return fmt.Errorf("%w: %s was sent by %s", errNotMessageSender, msgID, sender)
+	}
+	admin, err := isGroupAdmin(s.client, info.Chat, info.Sender, info.SenderAlt)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return fmt.Errorf("%w: %s was sent by %s and the revoker isn't a group admin", errNotMessageSender, msgID, sender)
+	}
+	return nil
+}
+
+// messageText returns the user-visible text of a message: the body for text
+// messages or the caption for media messages.
+func messageText(msg *waProto.Message) string {
+	switch {
+	case msg.GetConversation() != "":
+		return msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetCaption()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetCaption()
+	case msg.GetButtonsMessage() != nil:
+		return msg.GetButtonsMessage().GetContentText()
+	case msg.GetListMessage() != nil:
+		return msg.GetListMessage().GetDescription()
+	}
+	return ""
+}
+
+// messageContextInfo returns the context info of the message types that can
+// quote another message, or nil.
+func messageContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage().GetContextInfo()
+	case msg.GetLocationMessage() != nil:
+		return msg.GetLocationMessage().GetContextInfo()
+	case msg.GetContactMessage() != nil:
+		return msg.GetContactMessage().GetContextInfo()
+	case msg.GetButtonsMessage() != nil:
+		return msg.GetButtonsMessage().GetContextInfo()
+	case msg.GetListMessage() != nil:
+		return msg.GetListMessage().GetContextInfo()
+	case msg.GetButtonsResponseMessage() != nil:
+		return msg.GetButtonsResponseMessage().GetContextInfo()
+	case msg.GetListResponseMessage() != nil:
+		return msg.GetListResponseMessage().GetContextInfo()
+	case msg.GetTemplateButtonReplyMessage() != nil:
+		return msg.GetTemplateButtonReplyMessage().GetContextInfo()
+	}
+	return nil
+}
+
+// isButtonReply reports whether msg is a selection from a buttons, list or
+// template message.
+func isButtonReply(msg *waProto.Message) bool {
+	return msg.GetButtonsResponseMessage() != nil || msg.GetListResponseMessage() != nil || msg.GetTemplateButtonReplyMessage() != nil
+}
+
+// buttonReply returns the ID and display text of the button or list row
+// selected in a reply.
+func buttonReply(msg *waProto.Message) (id, text string) {
+	switch {
+	case msg.GetButtonsResponseMessage() != nil:
+		reply := msg.GetButtonsResponseMessage()
+		return reply.GetSelectedButtonID(), reply.GetSelectedDisplayText()
+	case msg.GetListResponseMessage() != nil:
+		reply := msg.GetListResponseMessage()
+		return reply.GetSingleSelectReply().GetSelectedRowID(), reply.GetTitle()
+	case msg.GetTemplateButtonReplyMessage() != nil:
+		reply := msg.GetTemplateButtonReplyMessage()
+		return reply.GetSelectedID(), reply.GetSelectedDisplayText()
+	}
+	return "", ""
+}
+
+// setContextInfo replaces the ContextInfo of msg. Plain text is turned into
+// an extended text message first, since only that can carry a ContextInfo.
+func setContextInfo(msg *waProto.Message, info *waProto.ContextInfo) {
+	if msg.Conversation != nil {
+		msg.ExtendedTextMessage = &waProto.ExtendedTextMessage{Text: msg.Conversation}
+		msg.Conversation = nil
+	}
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		msg.ExtendedTextMessage.ContextInfo = info
+	case msg.GetImageMessage() != nil:
+		msg.ImageMessage.ContextInfo = info
+	case msg.GetVideoMessage() != nil:
+		msg.VideoMessage.ContextInfo = info
+	case msg.GetDocumentMessage() != nil:
+		msg.DocumentMessage.ContextInfo = info
+	case msg.GetAudioMessage() != nil:
+		msg.AudioMessage.ContextInfo = info
+	case msg.GetStickerMessage() != nil:
+		msg.StickerMessage.ContextInfo = info
+	case msg.GetLocationMessage() != nil:
+		msg.LocationMessage.ContextInfo = info
+	case msg.GetContactMessage() != nil:
+		msg.ContactMessage.ContextInfo = info
+	case pollCreation(msg) != nil:
+		pollCreation(msg).ContextInfo = info
+	case msg.GetButtonsMessage() != nil:
+		msg.ButtonsMessage.ContextInfo = info
+	case msg.GetListMessage() != nil:
+		msg.ListMessage.ContextInfo = info
+	}
+}
+
+// replyContext builds the ReplyTo of a message from its context info. Replies
+// don't always embed the quoted message, so the preview falls back to our
+// stored copy of it.
+func replyContext(info *waProto.ContextInfo) *ReplyContext {
+	if info.GetStanzaID() == "" {
+		return nil
+	}
+	reply := &ReplyContext{
+		MessageID: info.GetStanzaID(),
+		SenderJID: info.GetParticipant(),
+	}
+	if quoted := info.GetQuotedMessage(); quoted != nil {
+		reply.Preview = messageText(quoted)
+	} else if stored, err := loadStoredMessage(reply.MessageID); err != nil {
+		dbLog.Debugf("Quoted message %s not available: %v", reply.MessageID, err)
+	} else {
+		reply.Preview = messageText(stored)
+	}
+	if runes := []rune(reply.Preview); len(runes) > replyPreviewLength {
+		reply.Preview = string(runes[:replyPreviewLength]) + "…"
+	}
+	return reply
 }
 
 // getRecentChatHistory fetches the last N messages for a chat and sorts them chronologically (ASC).
 func getRecentChatHistory(chatJID string, limit int) ([]map[string]interface{}, error) {
 	// Use the main getMessages function to ensure consistent output and logic.
 	// No sender, start time, or end time filters are applied.
-	return getMessages(chatJID, "", limit, 0, 0)
+	return getMessages(chatJID, "", limit, 0, 0, false)
+}
+
+// messageColumns are the columns executeMessageQuery expects, in order.
+const messageColumns = "message_id, timestamp, sender_jid, chat_jid, message_content, deleted, edited_at, from_me, status, deleted_at"
+
+// getMessage fetches a single message by ID, including deleted ones. It
+// returns nil if the message isn't stored.
+func getMessage(msgID string) (map[string]interface{}, error) {
+	messages, err := executeMessageQuery("SELECT "+messageColumns+" FROM messages WHERE message_id = ?", msgID)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return messages[0], nil
 }
 
 // getMessages fetches messages from the database with optional filters.
 // It returns the most recent messages matching the criteria, sorted chronologically (ASC).
-func getMessages(chatJID, senderJID string, limit int, startTime, endTime int64) ([]map[string]interface{}, error) {
+// Deleted messages are omitted unless includeDeleted is set.
+func getMessages(chatJID, senderJID string, limit int, startTime, endTime int64, includeDeleted bool) ([]map[string]interface{}, error) {
 	var baseQuery strings.Builder
 	var args []interface{}
 
 	// Base selection and filtering
-	baseQuery.WriteString("SELECT message_id, timestamp, sender_jid, chat_jid, message_content FROM messages WHERE 1=1")
+	baseQuery.WriteString("SELECT " + messageColumns + " FROM messages WHERE 1=1")
+	if !includeDeleted {
+		baseQuery.WriteString(" AND deleted = 0")
+	}
 	if chatJID != "" {
 		baseQuery.WriteString(" AND chat_jid = ?")
 		args = append(args, chatJID)
@@ -237,95 +724,654 @@ func executeMessageQuery(query string, args ...interface{}) ([]map[string]interf
 	}
 	defer rows.Close()
 
+	// Sender names come from the device store, which shares the connection
+	// pool; they're resolved after the rows are closed so a query never waits
+	// for a connection while holding one
+	var senders []types.JID
 	for rows.Next() {
 		var id, sender, chatJID string
 		var content []byte
 		var timestamp int64
+		var deleted, fromMe bool
+		var editedAt sql.NullInt64
+		var status sql.NullString
+		var deletedAt sql.NullInt64
 
-		if err := rows.Scan(&id, &timestamp, &sender, &chatJID, &content); err != nil {
-			fmt.Printf("Error scanning message row: %v\n", err)
+		if err := rows.Scan(&id, &timestamp, &sender, &chatJID, &content, &deleted, &editedAt, &fromMe, &status, &deletedAt); err != nil {
+			dbLog.Errorf("Error scanning message row: %v", err)
 			continue
 		}
 
-		// Convert timestamp to IST string
-		ist, err := time.LoadLocation("Asia/Kolkata")
-		if err != nil {
-			// Fallback to UTC if IST is not available
-			ist = time.UTC
-		}
-		formattedTime := time.Unix(timestamp, 0).In(ist).Format("Mon, 02 Jan 2006 15:04:05 MST")
+		// Convert timestamp to a string in the configured display timezone
+		formattedTime := formatTimestamp(timestamp)
 
 		parsedSenderJID, _ := types.ParseJID(sender)
-		isFromMe := false
-		if client.Store != nil && client.Store.ID != nil {
-			isFromMe = parsedSenderJID.User == client.Store.ID.User
-		}
+		// Messages are shared between sessions, so "from me" means from any of our accounts.
+		// Rows stored before from_me existed only have the sender to go by.
+		isFromMe := fromMe || sessions.IsOwnUser(parsedSenderJID.User)
 
 		msgMap := map[string]interface{}{
-			"id":        id,
-			"timestamp": formattedTime,
-			"sender":    sender,
-			"chat":      chatJID,
-			"isFromMe":  isFromMe,
-		}
-
-		var protoMsg waProto.Message
-		if err := proto.Unmarshal(content, &protoMsg); err == nil {
-			msgContent := make(map[string]string)
-			msgContent["type"] = "unsupported"
-			msgContent["body"] = "Message type not supported for content extraction."
-
-			switch {
-			case protoMsg.GetConversation() != "":
-				msgContent["type"] = "text"
-				msgContent["body"] = protoMsg.GetConversation()
-			case protoMsg.GetExtendedTextMessage() != nil:
-				msgContent["type"] = "text"
-				msgContent["body"] = protoMsg.GetExtendedTextMessage().GetText()
-			case protoMsg.GetImageMessage() != nil:
-				msgContent["type"] = "image"
-				msgContent["body"] = protoMsg.GetImageMessage().GetCaption()
-			case protoMsg.GetVideoMessage() != nil:
-				msgContent["type"] = "video"
-				msgContent["body"] = protoMsg.GetVideoMessage().GetCaption()
-			case protoMsg.GetDocumentMessage() != nil:
-				msgContent["type"] = "document"
-				msgContent["body"] = protoMsg.GetDocumentMessage().GetCaption()
-			case protoMsg.GetButtonsMessage() != nil:
-				msgContent["type"] = "buttons"
-				msgContent["body"] = protoMsg.GetButtonsMessage().GetContentText()
-			case protoMsg.GetListMessage() != nil:
-				msgContent["type"] = "list"
-				msgContent["body"] = protoMsg.GetListMessage().GetDescription()
+			"id":            id,
+			"timestamp":     formattedTime,
+			"timestampUnix": timestamp,
+			"sender":        sender,
+			"chat":          chatJID,
+			"isFromMe":      isFromMe,
+			"deleted":       deleted,
+			// Deletions for everyone are WhatsApp revokes; "revoked" names
+			// the same flag for agents that look for it
+			"revoked": deleted,
+		}
+		if editedAt.Valid {
+			msgMap["editedAt"] = formatTimestamp(editedAt.Int64)
+			msgMap["editedAtUnix"] = editedAt.Int64
+		}
+		if deletedAt.Valid {
+			msgMap["deletedAt"] = formatTimestamp(deletedAt.Int64)
+			msgMap["deletedAtUnix"] = deletedAt.Int64
+		}
+		if isFromMe {
+			msgMap["status"] = statusSent
+			if status.Valid {
+				msgMap["status"] = status.String
 			}
-			msgMap["content"] = msgContent
-		} else {
-			msgMap["content"] = map[string]string{"error": "Failed to parse message content"}
 		}
 
+		msgMap["content"] = storedContent(content, deleted)
+
 		messages = append(messages, msgMap)
+		senders = append(senders, parsedSenderJID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to fetch messages: %w", err)
+	}
+	rows.Close()
+	for i, msgMap := range messages {
+		msgMap["senderName"] = resolveContactName(senders[i])
 	}
 	return messages, nil
 }
 
+// storedContent decodes a stored message into the type/body map used in
+// history rows.
+func storedContent(content []byte, deleted bool) map[string]string {
+	var protoMsg waProto.Message
+	if deleted {
+		return map[string]string{"type": "deleted"}
+	}
+	if err := proto.Unmarshal(content, &protoMsg); err != nil {
+		return map[string]string{"error": "Failed to parse message content"}
+	}
+
+	msgContent := make(map[string]string)
+	msgContent["type"] = "unsupported"
+	msgContent["body"] = "Message type not supported for content extraction."
+
+	switch {
+	case protoMsg.GetConversation() != "":
+		msgContent["type"] = "text"
+		msgContent["body"] = protoMsg.GetConversation()
+	case protoMsg.GetExtendedTextMessage() != nil:
+		msgContent["type"] = "text"
+		msgContent["body"] = protoMsg.GetExtendedTextMessage().GetText()
+	case protoMsg.GetImageMessage() != nil:
+		msgContent["type"] = "image"
+		msgContent["body"] = protoMsg.GetImageMessage().GetCaption()
+	case protoMsg.GetVideoMessage() != nil:
+		msgContent["type"] = "video"
+		msgContent["body"] = protoMsg.GetVideoMessage().GetCaption()
+	case protoMsg.GetDocumentMessage() != nil:
+		msgContent["type"] = "document"
+		msgContent["body"] = protoMsg.GetDocumentMessage().GetCaption()
+	case protoMsg.GetLocationMessage() != nil:
+		loc := protoMsg.GetLocationMessage()
+		msgContent["type"] = "location"
+		msgContent["body"] = strings.TrimSpace(loc.GetName() + " " + loc.GetAddress())
+		msgContent["latitude"] = strconv.FormatFloat(loc.GetDegreesLatitude(), 'f', -1, 64)
+		msgContent["longitude"] = strconv.FormatFloat(loc.GetDegreesLongitude(), 'f', -1, 64)
+	case protoMsg.GetLiveLocationMessage() != nil:
+		loc := protoMsg.GetLiveLocationMessage()
+		msgContent["type"] = "location"
+		msgContent["body"] = loc.GetCaption()
+		msgContent["latitude"] = strconv.FormatFloat(loc.GetDegreesLatitude(), 'f', -1, 64)
+		msgContent["longitude"] = strconv.FormatFloat(loc.GetDegreesLongitude(), 'f', -1, 64)
+	case protoMsg.GetReactionMessage() != nil:
+		msgContent["type"] = "reaction"
+		msgContent["body"] = protoMsg.GetReactionMessage().GetText()
+		msgContent["targetMessageID"] = protoMsg.GetReactionMessage().GetKey().GetID()
+	case protoMsg.GetButtonsMessage() != nil:
+		msgContent["type"] = "buttons"
+		msgContent["body"] = protoMsg.GetButtonsMessage().GetContentText()
+	case protoMsg.GetListMessage() != nil:
+		msgContent["type"] = "list"
+		msgContent["body"] = protoMsg.GetListMessage().GetDescription()
+	case isButtonReply(&protoMsg):
+		msgContent["type"] = "button_reply"
+		msgContent["selectedID"], msgContent["body"] = buttonReply(&protoMsg)
+	}
+	// Keep reply chains visible in history
+	if quotedID := messageContextInfo(&protoMsg).GetStanzaID(); quotedID != "" {
+		msgContent["quotedMessageID"] = quotedID
+	}
+	return msgContent
+}
+
+// ChatSummary describes a known conversation and its most recent message.
+type ChatSummary struct {
+	ChatJID           string            `json:"chat"`
+	IsGroup           bool              `json:"isGroup"`
+	MessageCount      int               `json:"messageCount"`
+	LastMessageID     string            `json:"lastMessageID"`
+	LastSender        string            `json:"lastSender"`
+	LastTimestamp     string            `json:"lastTimestamp"`
+	LastTimestampUnix int64             `json:"lastTimestampUnix"`
+	LastMessage       map[string]string `json:"lastMessage"`
+}
+
+// getChats returns every chat with stored messages, most recently active first.
+func getChats() ([]ChatSummary, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+	rows, err := db.Query(`SELECT chat_jid, message_id, sender_jid, timestamp, message_content, message_count FROM (
+		SELECT chat_jid, message_id, sender_jid, timestamp, message_content,
+			ROW_NUMBER() OVER (PARTITION BY chat_jid ORDER BY timestamp DESC) AS rn,
+			COUNT(*) OVER (PARTITION BY chat_jid) AS message_count
+		FROM messages WHERE deleted = 0
+	) sub WHERE rn = 1 ORDER BY timestamp DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chats: %w", err)
+	}
+	defer rows.Close()
+
+	chats := []ChatSummary{}
+	for rows.Next() {
+		var chat ChatSummary
+		var content []byte
+		if err := rows.Scan(&chat.ChatJID, &chat.LastMessageID, &chat.LastSender, &chat.LastTimestampUnix, &content, &chat.MessageCount); err != nil {
+			dbLog.Errorf("Error scanning chat row: %v", err)
+			continue
+		}
+		if jid, err := types.ParseJID(chat.ChatJID); err == nil {
+			chat.IsGroup = jid.Server == types.GroupServer
+		}
+		chat.LastTimestamp = formatTimestamp(chat.LastTimestampUnix)
+		chat.LastMessage = storedContent(content, false)
+		chats = append(chats, chat)
+	}
+	return chats, rows.Err()
+}
+
+// loadDisplayLocation resolves the timezone used to format message timestamps.
+// DISPLAY_TIMEZONE takes precedence over TZ; invalid or missing zones fall back to UTC.
+func loadDisplayLocation() *time.Location {
+	name := os.Getenv("DISPLAY_TIMEZONE")
+	if name == "" {
+		name = os.Getenv("TZ")
+	}
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Warnf("Invalid display timezone %q, falling back to UTC: %v", name, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// formatTimestamp formats a Unix timestamp in the configured display timezone.
+func formatTimestamp(timestamp int64) string {
+	return time.Unix(timestamp, 0).In(displayLocation()).Format("Mon, 02 Jan 2006 15:04:05 MST")
+}
+
+// displayLocation returns the configured display timezone, defaulting to UTC.
+func displayLocation() *time.Location {
+	if displayLoc == nil {
+		return time.UTC
+	}
+	return displayLoc
+}
+
 func handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
 	var req SendMessageRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	jid, err := types.ParseJID(req.JID)
+	mentions, err := parseMentions(req.Mentions)
 	if err != nil {
-		http.Error(w, "Invalid JID: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	msg := &waProto.Message{Conversation: &req.Message}
-	resp, err := client.SendMessage(context.Background(), jid, msg)
+	if err := validateExpiration(req.ExpirationSeconds); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Recipients) > 0 {
+		recipients, err := batchRecipients(req.JID, req.Recipients)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		handleSendToRecipients(r.Context(), w, sess, recipients, req, mentions)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok || !allowSend(w, jid) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	msg, err := buildSendMessage(ctx, sess, jid, req, mentions)
+	if errors.Is(err, errNotGroupMember) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		writeMediaSendError(w, "Failed to prepare message", err)
+		return
+	}
+	resp, err := sess.sendMessage(ctx, jid, msg)
 	if err != nil {
-		http.Error(w, "Failed to send message: "+err.Error(), http.StatusInternalServerError)
+		writeOperationError(w, "Failed to send message", err)
 		return
 	}
-	fmt.Fprintf(w, "Message sent successfully! (ID: %s)", resp.ID)
+	writeJSON(w, http.StatusOK, newSendResult(jid, resp))
+}
+
+// resolveRecipientOrError resolves the recipient of a send, answering with a
+// 400 for recipients that are invalid or not on WhatsApp and a 403 for
+// channels the account can't post in.
+func resolveRecipientOrError(w http.ResponseWriter, sess *Session, raw string) (types.JID, bool) {
+	jid, err := sess.resolveRecipient(raw)
+	if isRecipientError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return types.JID{}, false
+	} else if errors.Is(err, errNotNewsletterAdmin) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return types.JID{}, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return types.JID{}, false
+	}
+	return jid, true
+}
+
+// batchRecipients returns the recipients of a send to several chats: jid, if
+// given, followed by recipients. Batches over maxBulkMessages are rejected.
+func batchRecipients(jid string, recipients []string) ([]string, error) {
+	if jid != "" {
+		recipients = append([]string{jid}, recipients...)
+	}
+	if len(recipients) > maxBulkMessages {
+		return nil, fmt.Errorf("at most %d recipients can be sent to at once", maxBulkMessages)
+	}
+	return recipients, nil
+}
+
+// handleSendToRecipients sends the same message to every recipient in turn,
+// pausing sendDelay between sends, and reports a result per recipient. The
+// remaining recipients are skipped when the client disconnects.
+func handleSendToRecipients(parent context.Context, w http.ResponseWriter, sess *Session, recipients []string, req SendMessageRequest, mentions []types.JID) {
+	results := make([]SendResult, 0, len(recipients))
+	for i, recipient := range recipients {
+		if i > 0 && !waitSendDelay(parent) {
+			apiLog.Warnf("Send cancelled by the client after %d of %d recipients", i, len(recipients))
+			return
+		}
+		results = append(results, sess.sendToRecipient(parent, recipient, req, mentions))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// sendToRecipient sends req to one recipient of a batch, reporting failures,
+// including rate limiting, in the result rather than as an HTTP error.
+func (s *Session) sendToRecipient(parent context.Context, recipient string, req SendMessageRequest, mentions []types.JID) SendResult {
+	result := SendResult{JID: recipient}
+	jid, err := s.resolveRecipient(recipient)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if wait := reserveSend(jid); wait > 0 {
+		result.Error = fmt.Sprintf("Send rate limit exceeded, retry after %ds", retryAfterSeconds(wait))
+		return result
+	}
+	ctx, cancel := context.WithTimeout(parent, sendTimeout)
+	defer cancel()
+	msg, err := buildSendMessage(ctx, s, jid, req, mentions)
+	if err != nil {
+		result.Error = "Failed to prepare message: " + err.Error()
+		return result
+	}
+	resp, err := s.sendMessage(ctx, jid, msg)
+	if err != nil {
+		result.Error = "Failed to send message: " + err.Error()
+		return result
+	}
+	return newSendResult(jid, resp)
+}
+
+func handleSendLocation(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SendLocationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok || !allowSend(w, jid) {
+		return
+	}
+	msg, err := buildLocationMessage(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	resp, err := sess.sendMessage(ctx, jid, msg)
+	if err != nil {
+		writeOperationError(w, "Failed to send location", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSendResult(jid, resp))
+}
+
+func handleSendContact(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SendContactRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok || !allowSend(w, jid) {
+		return
+	}
+	msg, err := buildContactMessage(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	resp, err := sess.sendMessage(ctx, jid, msg)
+	if err != nil {
+		writeOperationError(w, "Failed to send contact", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSendResult(jid, resp))
+}
+
+// errInvalidMessage is returned when a send request doesn't describe a valid
+// message of its type.
+var errInvalidMessage = errors.New("invalid message")
+
+// errMessageNotFound is returned for messages that aren't stored, or were
+// deleted.
+var errMessageNotFound = errors.New("message not found")
+
+// errNotMessageSender is returned when someone other than its sender tries to
+// change a stored message.
+var errNotMessageSender = errors.New("message was sent by someone else")
+
+// buildSendMessage builds the message of a POST /api/send request for one
+// recipient according to the request's type, making it disappear when
+// ExpirationSeconds is set. Media types are uploaded here.
+func buildSendMessage(ctx context.Context, sess *Session, to types.JID, req SendMessageRequest, mentions []types.JID) (*waProto.Message, error) {
+	if err := validateExpiration(req.ExpirationSeconds); err != nil {
+		return nil, err
+	}
+	msg, err := buildSendContent(ctx, sess, to, req, mentions)
+	if err != nil || req.ExpirationSeconds == 0 {
+		return msg, err
+	}
+	setExpiration(msg, req.ExpirationSeconds)
+	return msg, nil
+}
+
+// buildSendContent builds the message of the requested type.
+func buildSendContent(ctx context.Context, sess *Session, to types.JID, req SendMessageRequest, mentions []types.JID) (*waProto.Message, error) {
+	switch req.Type {
+	case "", "text":
+		return buildTextMessage(sess.client, to, req.Message, mentions)
+	case "location":
+		if req.Latitude == nil || req.Longitude == nil {
+			return nil, fmt.Errorf("%w: latitude and longitude are required", errInvalidMessage)
+		}
+		return buildLocationMessage(SendLocationRequest{
+			Latitude:  *req.Latitude,
+			Longitude: *req.Longitude,
+			Name:      req.Name,
+			Address:   req.Address,
+		})
+	case "contact":
+		return buildContactMessage(SendContactRequest{
+			DisplayName:  req.DisplayName,
+			VCard:        req.VCard,
+			Phone:        req.Phone,
+			Organization: req.Organization,
+			Email:        req.Email,
+		})
+	case "sticker":
+		return sess.buildStickerMessage(ctx, to, req.Data)
+	case "poll":
+		return buildPollMessage(sess.client, SendPollRequest{
+			Question:        req.Question,
+			Options:         req.Options,
+			SelectableCount: req.SelectableCount,
+		})
+	case "buttons":
+		return buildButtonsMessage(SendButtonsRequest{
+			Message: req.Message,
+			Footer:  req.Footer,
+			Buttons: req.Buttons,
+			AsText:  req.AsText,
+		})
+	case "list":
+		return buildListMessage(SendListRequest{
+			Title:      req.Title,
+			Message:    req.Message,
+			Footer:     req.Footer,
+			ButtonText: req.ButtonText,
+			Sections:   req.Sections,
+			AsText:     req.AsText,
+		})
+	default:
+		return nil, fmt.Errorf("%w: unsupported type %q", errInvalidMessage, req.Type)
+	}
+}
+
+// buildLocationMessage builds a LocationMessage after checking that the
+// coordinates are in range.
+func buildLocationMessage(req SendLocationRequest) (*waProto.Message, error) {
+	if req.Latitude < -90 || req.Latitude > 90 || req.Longitude < -180 || req.Longitude > 180 {
+		return nil, fmt.Errorf("%w: latitude must be within [-90, 90] and longitude within [-180, 180]", errInvalidMessage)
+	}
+	return &waProto.Message{
+		LocationMessage: &waProto.LocationMessage{
+			DegreesLatitude:  proto.Float64(req.Latitude),
+			DegreesLongitude: proto.Float64(req.Longitude),
+			Name:             proto.String(req.Name),
+			Address:          proto.String(req.Address),
+		},
+	}, nil
+}
+
+// buildContactMessage builds a ContactMessage from a raw vCard or, when none
+// is given, from the structured contact fields.
+func buildContactMessage(req SendContactRequest) (*waProto.Message, error) {
+	if req.DisplayName == "" {
+		return nil, fmt.Errorf("%w: displayName is required", errInvalidMessage)
+	}
+	vcard := strings.TrimSpace(req.VCard)
+	if vcard == "" {
+		if req.Phone == "" {
+			return nil, fmt.Errorf("%w: either vcard or phone is required", errInvalidMessage)
+		}
+		vcard = buildVCard(req)
+	} else if !strings.HasPrefix(strings.ToUpper(vcard), "BEGIN:VCARD") {
+		return nil, fmt.Errorf("%w: vcard must start with BEGIN:VCARD", errInvalidMessage)
+	}
+	return &waProto.Message{
+		ContactMessage: &waProto.ContactMessage{
+			DisplayName: proto.String(req.DisplayName),
+			Vcard:       proto.String(vcard),
+		},
+	}, nil
+}
+
+// buildVCard serializes the structured contact fields to a vCard 3.0 string.
+// The waid parameter lets WhatsApp link the card to the number's account.
+func buildVCard(req SendContactRequest) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, req.Phone)
+
+	var b strings.Builder
+	b.WriteString("BEGIN:VCARD\nVERSION:3.0\n")
+	fmt.Fprintf(&b, "FN:%s\n", req.DisplayName)
+	if req.Organization != "" {
+		fmt.Fprintf(&b, "ORG:%s;\n", req.Organization)
+	}
+	fmt.Fprintf(&b, "TEL;type=CELL;type=VOICE;waid=%s:+%s\n", digits, digits)
+	if req.Email != "" {
+		fmt.Fprintf(&b, "EMAIL:%s\n", req.Email)
+	}
+	b.WriteString("END:VCARD")
+	return b.String()
+}
+
+// errNotGroupMember is returned when a mentioned JID is not part of the target group.
+var errNotGroupMember = errors.New("mentioned JID is not a member of the group")
+
+// parseMentions parses the JIDs or phone numbers to @-mention in an outgoing
+// message.
+func parseMentions(raw []string) ([]types.JID, error) {
+	mentions := make([]types.JID, 0, len(raw))
+	for _, m := range raw {
+		jid, err := parseRecipient(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mention: %w", err)
+		}
+		mentions = append(mentions, jid)
+	}
+	return mentions, nil
+}
+
+// buildTextMessage builds an outgoing text message. Without mentions it is a
+// plain conversation message; with mentions it becomes an ExtendedTextMessage
+// listing the mentioned JIDs. WhatsApp only highlights mentions whose
+// @number token appears in the text, so every mention must have one, and
+// mentions in groups must refer to current group members.
+func buildTextMessage(cli *whatsmeow.Client, to types.JID, text string, mentions []types.JID) (*waProto.Message, error) {
+	if len(mentions) == 0 {
+		return &waProto.Message{Conversation: proto.String(text)}, nil
+	}
+	for _, m := range mentions {
+		if !containsMentionToken(text, m.User) {
+			return nil, fmt.Errorf("%w: mentioned %s but the message text doesn't contain @%s", errInvalidMessage, m.String(), m.User)
+		}
+	}
+	if to.Server == types.GroupServer {
+		if err := checkGroupMembers(cli, to, mentions); err != nil {
+			return nil, err
+		}
+	}
+
+	mentionedJIDs := make([]string, 0, len(mentions))
+	for _, m := range mentions {
+		mentionedJIDs = append(mentionedJIDs, m.ToNonAD().String())
+	}
+	return &waProto.Message{
+		ExtendedTextMessage: &waProto.ExtendedTextMessage{
+			Text: proto.String(text),
+			ContextInfo: &waProto.ContextInfo{
+				MentionedJID: mentionedJIDs,
+			},
+		},
+	}, nil
+}
+
+// containsMentionToken reports whether text contains "@user" as a whole
+// token, so "@9198" doesn't count as a mention of 919812345678.
+func containsMentionToken(text, user string) bool {
+	token := "@" + user
+	for i := strings.Index(text, token); i >= 0; {
+		end := i + len(token)
+		if end == len(text) || text[end] < '0' || text[end] > '9' {
+			return true
+		}
+		next := strings.Index(text[end:], token)
+		if next < 0 {
+			break
+		}
+		i = end + next
+	}
+	return false
+}
+
+// isGroupAdmin reports whether any of users, a participant's phone number or
+// LID address, is an admin of the group.
+func isGroupAdmin(cli *whatsmeow.Client, group types.JID, users ...types.JID) (bool, error) {
+	info, err := cli.GetGroupInfo(group)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch group info: %w", err)
+	}
+	for _, p := range info.Participants {
+		if !p.IsAdmin && !p.IsSuperAdmin {
+			continue
+		}
+		for _, user := range users {
+			if user.User == "" {
+				continue
+			}
+			if user.User == p.JID.User || user.User == p.PhoneNumber.User || user.User == p.LID.User {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// checkGroupMembers returns an error wrapping errNotGroupMember if any of the
+// given JIDs is not a participant of the group.
+func checkGroupMembers(cli *whatsmeow.Client, group types.JID, jids []types.JID) error {
+	info, err := cli.GetGroupInfo(group)
+	if err != nil {
+		return fmt.Errorf("failed to fetch group info: %w", err)
+	}
+	members := make(map[string]bool, len(info.Participants)*2)
+	for _, p := range info.Participants {
+		members[p.JID.User] = true
+		if !p.PhoneNumber.IsEmpty() {
+			members[p.PhoneNumber.User] = true
+		}
+		if !p.LID.IsEmpty() {
+			members[p.LID.User] = true
+		}
+	}
+	for _, jid := range jids {
+		if !members[jid.User] {
+			return fmt.Errorf("%w: %s", errNotGroupMember, jid.String())
+		}
+	}
+	return nil
 }
 
 func handleGetMessages(w http.ResponseWriter, r *http.Request) {
@@ -335,6 +1381,7 @@ func handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	limitStr := queryParams.Get("limit")
 	startTimeStr := queryParams.Get("start_time")
 	endTimeStr := queryParams.Get("end_time")
+	includeDeleted, _ := strconv.ParseBool(queryParams.Get("include_deleted"))
 
 	limit := 10 // Default limit
 	if limitStr != "" {
@@ -355,7 +1402,7 @@ func handleGetMessages(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	messages, err := getMessages(chatJID, senderJID, limit, startTime, endTime)
+	messages, err := getMessages(chatJID, senderJID, limit, startTime, endTime, includeDeleted)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to retrieve messages: %v", err), http.StatusInternalServerError)
 		return
@@ -365,11 +1412,90 @@ func handleGetMessages(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(messages)
 }
 
+func handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	messageID := mux.Vars(r)["messageID"]
+	message, err := getMessage(messageID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve message: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if message == nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, message)
+}
+
+// mediaMetadata is implemented by all downloadable media message types.
+type mediaMetadata interface {
+	GetMimetype() string
+	GetFileLength() uint64
+}
+
+func handleGetChats(w http.ResponseWriter, r *http.Request) {
+	chats, err := getChats()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve chats: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chats)
+}
+
+// exceedsMaxMediaBytes reports whether media of the given size is over the
+// MAX_MEDIA_BYTES limit.
+func exceedsMaxMediaBytes(size uint64) bool {
+	return maxMediaBytes > 0 && size > maxMediaBytes
+}
+
+// inlineMediaTimeout bounds the download of media that is sent inline.
+const inlineMediaTimeout = 30 * time.Second
+
+// inlineMedia downloads media no larger than inlineMediaMaxBytes into
+// content.Data so the agent doesn't need a second round-trip to downloadURL.
+// Larger media and failed downloads are left to the download URL.
+func (s *Session) inlineMedia(content *MessageContent, media interface{}) {
+	meta, ok := media.(mediaMetadata)
+	if !ok || meta.GetFileLength() == 0 || meta.GetFileLength() > inlineMediaMaxBytes || exceedsMaxMediaBytes(meta.GetFileLength()) {
+		return
+	}
+	downloadable, ok := media.(whatsmeow.DownloadableMessage)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), inlineMediaTimeout)
+	defer cancel()
+	data, err := s.client.Download(ctx, downloadable)
+	if err != nil {
+		eventLog.Warnf("Failed to download media for inlining, falling back to URL: %v", err)
+		return
+	}
+	content.Data = base64.StdEncoding.EncodeToString(data)
+}
+
 func handleDownload(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	messageID := vars["messageID"]
-	mediaData, ok := mediaMap.Load(messageID)
+	mediaData, cached := mediaMap.Load(messageID)
+
+	// Media saved by an earlier download outlives the cache and needs no connection
+	if saved, err := openSavedMedia(messageID); err == nil {
+		defer saved.Close()
+		if !cached {
+			if stored, err := loadStoredMessage(messageID); err == nil {
+				mediaData = messageMedia(stored)
+			}
+		}
+		mediaDownloads.WithLabelValues(resultLabel(nil)).Inc()
+		serveMedia(w, r, messageID, mediaData, saved)
+		return
+	}
+
+	sess, ok := connectedSessionFromRequest(w, r)
 	if !ok {
+		return
+	}
+	if !cached {
 		http.Error(w, "Media not found or expired", http.StatusNotFound)
 		return
 	}
@@ -378,13 +1504,97 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal server error: stored media is not downloadable", http.StatusInternalServerError)
 		return
 	}
-	data, err := client.Download(context.Background(), downloadable)
+	if meta, ok := mediaData.(mediaMetadata); ok && exceedsMaxMediaBytes(meta.GetFileLength()) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]interface{}{
+			"error":         "media is larger than the configured maximum",
+			"fileLength":    meta.GetFileLength(),
+			"maxMediaBytes": maxMediaBytes,
+		})
+		return
+	}
+
+	// Download into a temporary file rather than memory so large videos
+	// don't have to be buffered in full before being sent to the client.
+	// With MEDIA_DIR set the file is kept there for later downloads.
+	tmp, err := os.CreateTemp(mediaDir, "whatsapp-media-*")
+	if err != nil {
+		http.Error(w, "Failed to create temporary file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	ctx, cancel := context.WithTimeout(r.Context(), downloadTimeout)
+	defer cancel()
+	err = sess.downloadVerifiedToFile(ctx, messageID, downloadable, tmp)
+	mediaDownloads.WithLabelValues(resultLabel(err)).Inc()
+	if isMediaIntegrityError(err) {
+		http.Error(w, "Downloaded media failed the integrity check: "+err.Error(), http.StatusBadGateway)
+		return
+	} else if err != nil {
+		writeOperationError(w, "Failed to download media", err)
+		return
+	}
+	if mediaDir != "" {
+		if err := os.Rename(tmp.Name(), savedMediaPath(messageID)); err != nil {
+			apiLog.Warnf("Failed to save media %s: %v", messageID, err)
+		}
+	}
+	serveMedia(w, r, messageID, mediaData, tmp)
+}
+
+// serveMedia writes a downloaded media file, typed by the message metadata
+// when available. Range requests are supported so videos can be streamed.
+func serveMedia(w http.ResponseWriter, r *http.Request, messageID string, mediaData interface{}, f *os.File) {
+	info, err := f.Stat()
 	if err != nil {
-		http.Error(w, "Failed to download media: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to read downloaded media: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Failed to read downloaded media: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	size := info.Size()
+	contentType := ""
+	if meta, ok := mediaData.(mediaMetadata); ok {
+		contentType = meta.GetMimetype()
+		if fileLength := int64(meta.GetFileLength()); fileLength > 0 && fileLength != size {
+			apiLog.Warnf("Media %s is %d bytes but message declared %d", messageID, size, fileLength)
+		}
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if doc, ok := mediaData.(*waProto.DocumentMessage); ok && doc.GetFileName() != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": doc.GetFileName()}))
+	}
+	// ServeContent sniffs the content type when none is set
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeOperationError answers a failed WhatsApp operation: 503 when the
+// session went away, 504 with a JSON error when it ran out of time, 500
+// otherwise.
+func writeOperationError(w http.ResponseWriter, message string, err error) {
+	// The session can drop or be logged out between the connection check and the send
+	if errors.Is(err, whatsmeow.ErrNotConnected) || errors.Is(err, whatsmeow.ErrNotLoggedIn) {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": message + ": " + err.Error(), "code": "not_connected"})
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": message + ": timed out"})
 		return
 	}
-	w.Header().Set("Content-Type", http.DetectContentType(data))
-	w.Write(data)
+	http.Error(w, message+": "+err.Error(), http.StatusInternalServerError)
 }
 
 func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
@@ -395,17 +1605,24 @@ func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 		"server": "WhatsApp Server",
 		"version": "1.0.0",
 	}
-	
-	// Add WhatsApp connection status
-	if client != nil && client.IsConnected() {
+
+	// Add WhatsApp connection status of the default session, and a summary of all sessions
+	sess := sessions.Default()
+	status["whatsapp_logged_in"] = sess != nil && sess.client.IsLoggedIn()
+	if sess != nil && sess.client.IsConnected() {
 		status["whatsapp_connected"] = true
-		if client.Store != nil && client.Store.ID != nil {
-			status["device_jid"] = client.Store.ID.String()
+		if id := sess.JID(); !id.IsEmpty() {
+			status["device_jid"] = id.String()
 		}
 	} else {
 		status["whatsapp_connected"] = false
 	}
-	
+	sessionInfos := []SessionInfo{}
+	for _, s := range sessions.All() {
+		sessionInfos = append(sessionInfos, s.Info())
+	}
+	status["sessions"] = sessionInfos
+
 	// Add database status
 	if db != nil {
 		if err := db.Ping(); err == nil {
@@ -421,6 +1638,23 @@ func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(status)
 }
 
+// handleReady reports whether the server can currently serve WhatsApp traffic:
+// 200 when the default session is logged in and the database is reachable, 503 otherwise.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	sess := sessions.Default()
+	loggedIn := sess != nil && sess.client.IsLoggedIn()
+	dbReady := db != nil && db.Ping() == nil
+	status := http.StatusOK
+	if !loggedIn || !dbReady {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]bool{
+		"ready":              status == http.StatusOK,
+		"whatsapp_logged_in": loggedIn,
+		"database_connected": dbReady,
+	})
+}
+
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	uptime := time.Since(startTime)
@@ -434,17 +1668,39 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		"server_url": serverBaseURL,
 		"agent_url": agentBaseURL,
 	}
-	
+	// WhatsApp state of the default session, for clients that poll rather
+	// than rely on the status pushed to the agent
+	if sess := sessions.Default(); sess != nil {
+		status["whatsapp"] = sess.Info()
+	}
+
 	json.NewEncoder(w).Encode(status)
 }
 
-func postJSON(url string, data interface{}) {
-	body, err := json.Marshal(data)
+// sqliteDSN builds the connection string for the database file. WAL mode lets
+// history reads proceed while messages are being written, and the busy
+// timeout makes writers wait for a lock instead of failing with
+// "database is locked". Transactions take the write lock when they begin:
+// a transaction that reads first and then writes, like applyMessageEdit or
+// whatsmeow's store updates, would otherwise fail immediately when another
+// connection wrote in between, since SQLite can't wait out that conflict.
+// With WAL, synchronous=NORMAL is still safe against corruption and avoids
+// an fsync per write.
+func sqliteDSN(path string, busyTimeout time.Duration) string {
+	return fmt.Sprintf("file:%s?_foreign_keys=on&_journal_mode=WAL&_synchronous=NORMAL&_txlock=immediate&_busy_timeout=%d", path, busyTimeout.Milliseconds())
+}
+
+// ensureWritable creates the parent directory of path if needed and checks
+// that the database file can be opened for writing.
+func ensureWritable(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		fmt.Printf("Error marshalling JSON for %s: %v\n", url, err)
-		return
+		return err
 	}
-	http.Post(url, "application/json", bytes.NewBuffer(body))
+	return f.Close()
 }
 
 func createMessagesTable() error {
@@ -455,53 +1711,299 @@ func createMessagesTable() error {
 		message_id TEXT PRIMARY KEY,
 		chat_jid TEXT NOT NULL,
 		sender_jid TEXT NOT NULL,
-		message_content BLOB,
-		timestamp INTEGER
+		message_content ` + db.blobType() + `,
+		timestamp BIGINT
 	)`)
 	if err != nil {
 		return fmt.Errorf("failed to create table: %w", err)
 	}
+	if err := addColumnIfMissing("messages", "deleted", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("messages", "deleted_at", "BIGINT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("messages", "edited_at", "BIGINT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("messages", "from_me", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("messages", "status", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("messages", "session_id", "TEXT"); err != nil {
+		return err
+	}
+	// History and chat list queries filter by chat or sender and sort by
+	// time; time range queries across all chats and retention pruning filter
+	// by time alone
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_messages_chat_timestamp ON messages (chat_jid, timestamp)",
+		"CREATE INDEX IF NOT EXISTS idx_messages_sender_timestamp ON messages (sender_jid, timestamp)",
+		"CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages (timestamp)",
+	}
+	for _, stmt := range indexes {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
 	return nil
 }
 
-func storeMessage(msgID string, chatJID, senderJID types.JID, content []byte, timestamp time.Time) error {
+// addColumnIfMissing adds a column to an existing table so databases created
+// by older versions pick up new fields.
+func addColumnIfMissing(table, column, definition string) error {
+	if db.isPostgres() {
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, definition)); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+		}
+		return nil
+	}
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to read table info for %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read table info for %s: %w", table, err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// storeMessage inserts a message into the messages table, attributed to the
+// session sessionID that received or sent it. Redelivered messages with an
+// already stored message_id are ignored; the returned bool reports whether
+// the message was newly inserted.
+func storeMessage(sessionID, msgID string, chatJID, senderJID types.JID, fromMe bool, content []byte, timestamp time.Time) (bool, error) {
 	if db == nil {
-		fmt.Println("storeMessage: Database connection is nil")
-		return fmt.Errorf("database connection is not initialized")
+		return false, fmt.Errorf("database connection is not initialized")
 	}
-	fmt.Printf("storeMessage: Preparing to insert message ID %s\n", msgID)
+	dbLog.Debugf("storeMessage: Preparing to insert message ID %s", msgID)
 
-	stmt, err := db.Prepare("INSERT INTO messages (message_id, chat_jid, sender_jid, message_content, timestamp) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := db.Prepare("INSERT INTO messages (message_id, session_id, chat_jid, sender_jid, from_me, message_content, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT(message_id) DO NOTHING")
 	if err != nil {
-		fmt.Printf("storeMessage: Failed to prepare statement: %v\n", err)
-		return fmt.Errorf("failed to prepare statement: %w", err)
+		return false, fmt.Errorf("failed to prepare statement: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(msgID, chatJID.String(), senderJID.String(), content, timestamp.Unix())
+	// from_me is an integer column, which Postgres won't fill from a boolean
+	fromMeValue := 0
+	if fromMe {
+		fromMeValue = 1
+	}
+	res, err := stmt.Exec(msgID, sessionID, chatJID.String(), senderJID.String(), fromMeValue, content, timestamp.Unix())
 	if err != nil {
-		fmt.Printf("storeMessage: Failed to execute statement for message ID %s: %v\n", msgID, err)
-		return fmt.Errorf("failed to execute statement: %w", err)
+		return false, fmt.Errorf("failed to execute statement: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to read affected rows: %w", err)
+	}
+	if affected == 0 {
+		// Redeliveries after a reconnect are expected, so this isn't an error
+		dbLog.Debugf("storeMessage: Message %s already stored, skipping", msgID)
+		return false, nil
+	}
+	dbLog.Debugf("Successfully stored message %s from %s in chat %s", msgID, senderJID.String(), chatJID.String())
+	return true, nil
+}
+
+// applyMessageEdit overwrites the stored content of a message sent in chat by
+// one of senders (a user's phone number and LID address), records when it was
+// edited, and returns the previous content. Edits of messages that aren't
+// stored in that chat, or were deleted, fail with errMessageNotFound and
+// edits by anyone but the original sender with errNotMessageSender, leaving
+// the message untouched.
+func applyMessageEdit(msgID string, chat types.JID, content []byte, editedAt time.Time, senders ...types.JID) ([]byte, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database connection is not initialized")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var previous []byte
+	var storedSender string
+	err = tx.QueryRow(db.rebind("SELECT message_content, sender_jid FROM messages WHERE message_id = ? AND chat_jid = ? AND deleted = 0"),
+		msgID, chat.String()).Scan(&previous, &storedSender)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s in %s", errMessageNotFound, msgID, chat)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load message: %w", err)
+	}
+	if !sentBy(storedSender, senders) {
+		return nil, fmt.Errorf("%w: %s was sent by %s", errNotMessageSender, msgID, storedSender)
+	}
+	if _, err := tx.Exec(db.rebind("UPDATE messages SET message_content = ?, edited_at = ? WHERE message_id = ? AND chat_jid = ? AND sender_jid = ? AND deleted = 0"),
+		content, editedAt.Unix(), msgID, chat.String(), storedSender); err != nil {
+		return nil, fmt.Errorf("failed to update message: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit edit: %w", err)
+	}
+	return previous, nil
+}
+
+// sentBy reports whether a stored sender JID is one of senders. Senders are
+// stored with the device that sent the message, which needn't be the one
+// changing it, so only the users are compared.
+func sentBy(storedSender string, senders []types.JID) bool {
+	stored, err := types.ParseJID(storedSender)
+	if err != nil || stored.User == "" {
+		return false
+	}
+	for _, sender := range senders {
+		if sender.User == stored.User {
+			return true
+		}
+	}
+	return false
+}
+
+// loadStoredMessage returns the stored content of a message that hasn't been
+// deleted.
+func loadStoredMessage(msgID string) (*waProto.Message, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database connection is not initialized")
+	}
+	var content []byte
+	err := db.QueryRow("SELECT message_content FROM messages WHERE message_id = ? AND deleted = 0", msgID).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", errMessageNotFound, msgID)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load message: %w", err)
+	}
+	var msg waProto.Message
+	if err := proto.Unmarshal(content, &msg); err != nil {
+		return nil, fmt.Errorf("failed to decode message: %w", err)
+	}
+	return &msg, nil
+}
+
+// storedSender returns the sender JID of a message stored in chat that
+// hasn't been deleted, or errMessageNotFound.
+func storedSender(msgID string, chat types.JID) (string, error) {
+	if db == nil {
+		return "", fmt.Errorf("database connection is not initialized")
+	}
+	var sender string
+	err := db.QueryRow("SELECT sender_jid FROM messages WHERE message_id = ? AND chat_jid = ? AND deleted = 0", msgID, chat.String()).Scan(&sender)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: %s in %s", errMessageNotFound, msgID, chat)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to load message: %w", err)
+	}
+	return sender, nil
+}
+
+// markMessageDeleted tombstones a message stored in chat: its content is
+// cleared and it is flagged as deleted so history queries can hide it.
+// Messages that aren't stored in chat, or were already deleted, fail with
+// errMessageNotFound.
+func markMessageDeleted(msgID string, chat types.JID, deletedAt time.Time) error {
+	if db == nil {
+		return fmt.Errorf("database connection is not initialized")
+	}
+	res, err := db.Exec("UPDATE messages SET deleted = 1, deleted_at = ?, message_content = NULL WHERE message_id = ? AND chat_jid = ? AND deleted = 0",
+		deletedAt.Unix(), msgID, chat.String())
+	if err != nil {
+		return fmt.Errorf("failed to mark message deleted: %w", err)
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("%w: %s in %s", errMessageNotFound, msgID, chat)
 	}
-	fmt.Printf("Successfully stored message %s from %s in chat %s\n", msgID, senderJID.String(), chatJID.String())
 	return nil
 }
 
+// registerSessionRoutes adds the endpoints that act on a WhatsApp session.
+func registerSessionRoutes(r *mux.Router) {
+	r.HandleFunc("/qr", handleGetQR).Methods("GET")
+	r.HandleFunc("/login", handleLogin).Methods("POST")
+	r.HandleFunc("/logout", handleLogout).Methods("POST")
+	r.HandleFunc("/send", handleSendMessage).Methods("POST")
+	r.HandleFunc("/send/bulk", handleSendBulk).Methods("POST")
+	r.HandleFunc("/forward", handleForward).Methods("POST")
+	r.HandleFunc("/delete", handleDeleteMessage).Methods("POST")
+	r.HandleFunc("/edit", handleEditMessage).Methods("POST")
+	r.HandleFunc("/disappearing", handleSetDisappearingTimer).Methods("POST")
+	r.HandleFunc("/group/create", handleCreateGroup).Methods("POST")
+	r.HandleFunc("/group/join", handleJoinGroup).Methods("POST")
+	r.HandleFunc("/group/{jid}/{action:add|remove|promote|demote}", handleUpdateParticipants).Methods("POST")
+	r.HandleFunc("/group/{jid}/invite", handleGetGroupInvite).Methods("GET")
+	r.HandleFunc("/group/{jid}/invite/revoke", handleRevokeGroupInvite).Methods("POST")
+	r.HandleFunc("/chat/state", handleGetChatState).Methods("GET")
+	r.HandleFunc("/chat/archive", handleArchiveChat).Methods("POST")
+	r.HandleFunc("/chat/pin", handlePinChat).Methods("POST")
+	r.HandleFunc("/chat/mute", handleMuteChat).Methods("POST")
+	r.HandleFunc("/presence", handleSetPresence).Methods("POST")
+	r.HandleFunc("/presence/subscribe", handleSubscribePresence).Methods("POST")
+	r.HandleFunc("/chatpresence", handleSetChatPresence).Methods("POST")
+	r.HandleFunc("/send/location", handleSendLocation).Methods("POST")
+	r.HandleFunc("/send/contact", handleSendContact).Methods("POST")
+	r.HandleFunc("/send/poll", handleSendPoll).Methods("POST")
+	r.HandleFunc("/send/buttons", handleSendButtons).Methods("POST")
+	r.HandleFunc("/send/list", handleSendList).Methods("POST")
+	r.HandleFunc("/send/audio", handleSendAudio).Methods("POST")
+	r.HandleFunc("/send/sticker", handleSendSticker).Methods("POST")
+	r.HandleFunc("/onwhatsapp", handleOnWhatsApp).Methods("POST")
+	r.HandleFunc("/contacts", handleGetContacts).Methods("GET")
+	r.HandleFunc("/download/{messageID}", handleDownload).Methods("GET")
+	r.HandleFunc("/thumbnail/{messageID}", handleThumbnail).Methods("GET")
+	r.HandleFunc("/avatar/{jid}", handleAvatar).Methods("GET")
+}
+
 func startAPIServer() {
 	router := mux.NewRouter()
 	
 	// Health and status endpoints
 	router.HandleFunc("/health", handleHealthCheck).Methods("GET")
+	router.HandleFunc("/ready", handleReady).Methods("GET")
 	router.HandleFunc("/status", handleStatus).Methods("GET")
 	router.HandleFunc("/", handleStatus).Methods("GET") // Root endpoint also shows status
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
 	
 	// API endpoints
-	router.HandleFunc("/api/send", handleSendMessage).Methods("POST")
 	router.HandleFunc("/api/messages", handleGetMessages).Methods("GET")
-	router.HandleFunc("/api/download/{messageID}", handleDownload).Methods("GET")
+	router.HandleFunc("/api/messages/{messageID}", handleGetMessage).Methods("GET")
+	router.HandleFunc("/api/message/{messageID}", handleGetMessage).Methods("GET")
+	router.HandleFunc("/api/media/{messageID}/info", handleMediaInfo).Methods("GET")
+	router.HandleFunc("/api/chats", handleGetChats).Methods("GET")
+	router.HandleFunc("/api/history/batch", handleHistoryBatch).Methods("POST")
+	router.HandleFunc("/api/deadletters", handleListDeadLetters).Methods("GET")
+	router.HandleFunc("/api/deadletters/{id}/retry", handleRetryDeadLetter).Methods("POST")
+	router.HandleFunc("/api/deadletters/{id}", handleDeleteDeadLetter).Methods("DELETE")
+	router.HandleFunc("/api/sessions", handleListSessions).Methods("GET")
+	router.HandleFunc("/api/sessions", handleCreateSession).Methods("POST")
+	router.HandleFunc("/api/sessions/{session:[0-9]+}", handleDeleteSession).Methods("DELETE")
 	router.HandleFunc("/api/health", handleHealthCheck).Methods("GET")
 	router.HandleFunc("/api/status", handleStatus).Methods("GET")
-	
+	router.HandleFunc("/api/events", handleEvents).Methods("GET")
+	router.HandleFunc("/ws", handleWebSocket).Methods("GET")
+
+	// Session endpoints act on the default session, or on a specific one
+	// when prefixed with its phone number, e.g. /api/919812345678/send
+	registerSessionRoutes(router.PathPrefix("/api").Subrouter())
+	registerSessionRoutes(router.PathPrefix("/api/{session:[0-9]+}").Subrouter())
+
 	// Use environment variables for server configuration
 	serverPort = os.Getenv("PORT")
 	if serverPort == "" {
@@ -513,33 +2015,56 @@ func startAPIServer() {
 		serverBaseURL = fmt.Sprintf("http://localhost:%s", serverPort)
 	}
 	
-	fmt.Printf("Starting API server on %s\n", serverBaseURL)
-	if err := http.ListenAndServe(":"+serverPort, router); err != nil {
-		fmt.Fprintf(os.Stderr, "API server error: %v\n", err)
+	apiLog.Infof("Starting API server on %s", serverBaseURL)
+	configureCORS()
+	if err := http.ListenAndServe(":"+serverPort, accessLogMiddleware(corsMiddleware(router))); err != nil {
+		apiLog.Errorf("API server error: %v", err)
 	}
 }
 
 func main() {
 	startTime = time.Now() // Initialize start time for uptime tracking
 	
-	log := waLog.Stdout("Main", "INFO", true)
-	if err := godotenv.Load(); err != nil {
-		log.Warnf("Could not load .env file, relying on environment variables: %v", err)
+	envErr := godotenv.Load()
+	setupLogging()
+	if envErr != nil {
+		log.Warnf("Could not load .env file, relying on environment variables: %v", envErr)
 	}
 	agentBaseURL = os.Getenv("DUMMY_AGENT_BASE_URL")
 	if agentBaseURL == "" {
 		panic("DUMMY_AGENT_BASE_URL environment variable not set.")
 	}
-	dbLog := waLog.Stdout("Database", "INFO", true)
-
-	// Ensure data directory exists
-	if err := os.MkdirAll("data", 0755); err != nil {
-		log.Warnf("Failed to create data directory: %v", err)
+	displayLoc = loadDisplayLocation()
+	log.Infof("Displaying message timestamps in %s", displayLoc.String())
+	sendDelay = envDuration("SEND_DELAY", 500*time.Millisecond)
+	sendTimeout = envDuration("SEND_TIMEOUT", 30*time.Second)
+	downloadTimeout = envDuration("DOWNLOAD_TIMEOUT", 60*time.Second)
+	verifyRecipients = envBool("VERIFY_RECIPIENTS", false)
+	chatSendLimiter = newRateLimiter(envInt("SEND_RATE_PER_MINUTE", 0), envInt("SEND_BURST", 5))
+	globalSendLimiter = newRateLimiter(envInt("GLOBAL_SEND_RATE_PER_MINUTE", 0), envInt("GLOBAL_SEND_BURST", 10))
+	recipientCooldown = newCooldownLimiter(envDuration("SEND_COOLDOWN", 0))
+	configureAgentDelivery()
+	historyContextSize = envInt("HISTORY_CONTEXT_SIZE", 10)
+	inlineMediaMaxBytes = uint64(envInt("INLINE_MEDIA_MAX_BYTES", 0))
+	maxMediaBytes = uint64(envInt("MAX_MEDIA_BYTES", 0))
+	mediaMap = newMediaCache(envDuration("MEDIA_TTL", 24*time.Hour), envInt("MEDIA_CACHE_SIZE", 1000))
+	avatarCache = newMediaCache(envDuration("AVATAR_TTL", time.Hour), envInt("AVATAR_CACHE_SIZE", 500))
+	eventStream = newEventHub(envInt("SSE_BUFFER_SIZE", 100))
+	if d := envDuration("SSE_KEEPALIVE", sseKeepAlive); d > 0 {
+		sseKeepAlive = d
+	}
+	apiKey = os.Getenv("API_KEY")
+	if d := envDuration("WS_PING_INTERVAL", wsPingInterval); d > 0 {
+		wsPingInterval = d
+	}
+	if mediaDir = os.Getenv("MEDIA_DIR"); mediaDir != "" {
+		if err := os.MkdirAll(mediaDir, 0755); err != nil {
+			panic(fmt.Sprintf("Media directory %s is not usable: %v", mediaDir, err))
+		}
 	}
 
 	var err error
-	// Use data directory for database file
-	db, err = sql.Open("sqlite3", "file:data/whatsapp.db?_foreign_keys=on&_journal_mode=WAL")
+	db, err = openDatabase()
 	if err != nil {
 		panic(fmt.Sprintf("Failed to open database: %v", err))
 	}
@@ -554,46 +2079,58 @@ func main() {
 	if err := createMessagesTable(); err != nil {
 		panic(fmt.Sprintf("Failed to create messages table: %v", err))
 	}
+	if err := createAgentQueueTable(); err != nil {
+		panic(fmt.Sprintf("Failed to create agent queue table: %v", err))
+	}
+	if err := createDeadLettersTable(); err != nil {
+		panic(fmt.Sprintf("Failed to create dead letters table: %v", err))
+	}
+	messageWriter = newStorageWriter(envInt("STORE_QUEUE_SIZE", storeQueueSize))
+	go drainAgentQueue()
+	configureRetention()
+	go pruneMessagesPeriodically()
 
 	// Initialize WhatsApp store container
-	container = sqlstore.NewWithDB(db, "sqlite3", dbLog)
+	container = sqlstore.NewWithDB(db.DB, db.driver, dbLog)
 	
 	// Ensure database schema is up to date and tables are created
 	if err := container.Upgrade(context.Background()); err != nil {
 		log.Warnf("Failed to upgrade database schema: %v", err)
 	}
-	
-	// Ensure WhatsApp tables are created by attempting to get/create device
-	deviceStore, err := container.GetFirstDevice(context.Background())
-	if err != nil {
-		// If the error is about missing table, create a new device instead
-		log.Infof("No existing device found, creating new device: %v", err)
-		deviceStore = container.NewDevice()
-	}
 
-	client = whatsmeow.NewClient(deviceStore, waLog.Stdout("Client", "INFO", true))
-	client.AddEventHandler(eventHandler)
+	eventWorkers = envInt("EVENT_WORKERS", 4)
+	eventQueueSize = envInt("EVENT_QUEUE_SIZE", 100)
+	if d := envDuration("RECONNECT_MIN_BACKOFF", reconnectMinBackoff); d > 0 {
+		reconnectMinBackoff = d
+	}
+	reconnectMaxBackoff = max(envDuration("RECONNECT_MAX_BACKOFF", reconnectMaxBackoff), reconnectMinBackoff)
 
-	if client.Store.ID == nil {
-		fmt.Println("No session found. Starting QR login...")
-		qrChan, _ := client.GetQRChannel(context.Background())
-		if err := client.Connect(); err != nil {
+	// Start a session for every device in the store
+	devices, err := container.GetAllDevices(context.Background())
+	if err != nil {
+		log.Warnf("Failed to load devices: %v", err)
+	}
+	if len(devices) == 0 {
+		log.Infof("No session found. Starting QR login...")
+		sess := newSession(container.NewDevice())
+		sessions.Add(sess)
+		if err := sess.startQRLogin(); err != nil {
 			panic(fmt.Sprintf("Failed to connect: %v", err))
 		}
-		for qr := range qrChan {
-			fmt.Printf("QR code string received. Pushing to agent at %s/api/qr\n", agentBaseURL)
-			postJSON(agentBaseURL+"/api/qr", map[string]string{"qr": qr.Code})
-		}
-	} else {
-		fmt.Println("Previous session found. Attempting to connect...")
-		if err := client.Connect(); err != nil {
-			panic(fmt.Sprintf("Failed to connect with existing session: %v. Please delete whatsapp.db and try again.", err))
+	}
+	for _, device := range devices {
+		sess := newSession(device)
+		sessions.Add(sess)
+		log.Infof("Previous session %s found. Attempting to connect...", device.ID)
+		if err := sess.client.Connect(); err != nil {
+			log.Errorf("Failed to connect session %s: %v. Retrying in the background; to pair again, log it out via /api/%s/logout?force=true.", device.ID, err, sess.ID())
+			sess.startReconnect()
 		}
 	}
 	go startAPIServer()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
-	fmt.Println("\nShutting down...")
-	client.Disconnect()
+	log.Infof("Shutting down...")
+	sessions.DisconnectAll()
 }
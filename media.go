@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// MediaInfo describes a media message without downloading it. Dimensions
+// are set for images, videos and stickers, Seconds for audio and video.
+type MediaInfo struct {
+	MessageID  string `json:"messageID"`
+	Type       string `json:"type"`
+	Mimetype   string `json:"mimetype,omitempty"`
+	FileLength uint64 `json:"fileLength"`
+	FileName   string `json:"fileName,omitempty"`
+	Width      uint32 `json:"width,omitempty"`
+	Height     uint32 `json:"height,omitempty"`
+	Seconds    uint32 `json:"seconds,omitempty"`
+}
+
+// messageMedia returns the media part of a message, or nil if it has none.
+func messageMedia(msg *waProto.Message) interface{} {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage()
+	case msg.GetStickerMessage() != nil:
+		return msg.GetStickerMessage()
+	}
+	return nil
+}
+
+// newMediaInfo describes a media message part as returned by messageMedia.
+func newMediaInfo(messageID string, media interface{}) (MediaInfo, error) {
+	info := MediaInfo{MessageID: messageID}
+	switch m := media.(type) {
+	case *waProto.ImageMessage:
+		info.Type = "image"
+		info.Width, info.Height = m.GetWidth(), m.GetHeight()
+	case *waProto.VideoMessage:
+		info.Type = "video"
+		info.Width, info.Height = m.GetWidth(), m.GetHeight()
+		info.Seconds = m.GetSeconds()
+	case *waProto.DocumentMessage:
+		info.Type = "document"
+		info.FileName = m.GetFileName()
+	case *waProto.AudioMessage:
+		info.Type = "audio"
+		info.Seconds = m.GetSeconds()
+	case *waProto.StickerMessage:
+		info.Type = "sticker"
+		info.Width, info.Height = m.GetWidth(), m.GetHeight()
+	default:
+		return info, fmt.Errorf("unsupported media type %T", media)
+	}
+	meta := media.(mediaMetadata)
+	info.Mimetype = meta.GetMimetype()
+	info.FileLength = meta.GetFileLength()
+	return info, nil
+}
+
+// savedMediaPath is where media of a message is kept under MEDIA_DIR.
+// Message IDs are alphanumeric; anything else is hashed into the name so an
+// ID can never point outside the directory.
+func savedMediaPath(messageID string) string {
+	name := messageID
+	if name == "" || strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_-") != "" {
+		name = fmt.Sprintf("%x", sha256.Sum256([]byte(messageID)))
+	}
+	return filepath.Join(mediaDir, name)
+}
+
+// openSavedMedia opens media kept by an earlier download.
+func openSavedMedia(messageID string) (*os.File, error) {
+	if mediaDir == "" {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(savedMediaPath(messageID))
+}
+
+// removeSavedMedia deletes kept media, e.g. when the message is revoked.
+func removeSavedMedia(messageID string) {
+	if mediaDir == "" {
+		return
+	}
+	if err := os.Remove(savedMediaPath(messageID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		apiLog.Warnf("Failed to remove saved media %s: %v", messageID, err)
+	}
+}
+
+// handleMediaInfo returns the size, type and dimensions of a media message so
+// clients can decide whether to download it. Media that has left the cache
+// is described from the stored message.
+func handleMediaInfo(w http.ResponseWriter, r *http.Request) {
+	messageID := mux.Vars(r)["messageID"]
+	media, ok := mediaMap.Load(messageID)
+	if !ok {
+		stored, err := loadStoredMessage(messageID)
+		if err != nil {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		if media = messageMedia(stored); media == nil {
+			http.Error(w, "Message has no media", http.StatusNotFound)
+			return
+		}
+	}
+	info, err := newMediaInfo(messageID, media)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// errMediaTooLarge is returned for uploads over MAX_MEDIA_BYTES.
+var errMediaTooLarge = errors.New("media is larger than the configured maximum")
+
+// maxWaveformSamples is the number of samples WhatsApp draws for a voice note.
+const maxWaveformSamples = 64
+
+// SendAudioRequest is the body of POST /api/send/audio. Data is the
+// base64-encoded file. PTT (default true) sends it as a voice note, which
+// WhatsApp only renders for Ogg/Opus audio. Waveform holds up to 64 samples
+// from 0 to 100; no waveform is computed when it is left out.
+type SendAudioRequest struct {
+	JID      string `json:"jid"`
+	Data     string `json:"data"`
+	Mimetype string `json:"mimetype,omitempty"`
+	Seconds  uint32 `json:"seconds,omitempty"`
+	PTT      *bool  `json:"ptt,omitempty"`
+	Waveform []int  `json:"waveform,omitempty"`
+}
+
+// decodeMediaData decodes base64 media from a send request, enforcing
+// MAX_MEDIA_BYTES.
+func decodeMediaData(data string) ([]byte, error) {
+	if data == "" {
+		return nil, fmt.Errorf("%w: data is required", errInvalidMessage)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: data is not valid base64: %v", errInvalidMessage, err)
+	}
+	if exceedsMaxMediaBytes(uint64(len(decoded))) {
+		return nil, errMediaTooLarge
+	}
+	return decoded, nil
+}
+
+// uploadMedia uploads media for a message to the given recipient.
+func (s *Session) uploadMedia(ctx context.Context, to types.JID, data []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	// Channel media is uploaded unencrypted and referenced differently
+	if to.Server == types.NewsletterServer {
+		return whatsmeow.UploadResponse{}, fmt.Errorf("%w: media can't be sent to channels", errInvalidMessage)
+	}
+	return s.client.Upload(ctx, data, mediaType)
+}
+
+// isMediaIntegrityError reports whether downloaded media failed whatsmeow's
+// checks against the message: the FileEncSHA256 of the encrypted data, its
+// MAC, and the FileSHA256 and FileLength of the decrypted file.
+func isMediaIntegrityError(err error) bool {
+	return errors.Is(err, whatsmeow.ErrInvalidMediaEncSHA256) ||
+		errors.Is(err, whatsmeow.ErrInvalidMediaHMAC) ||
+		errors.Is(err, whatsmeow.ErrInvalidMediaSHA256) ||
+		errors.Is(err, whatsmeow.ErrFileLengthMismatch)
+}
+
+// downloadVerifiedToFile downloads media into f. Data that fails the
+// integrity checks is usually a transfer corrupted on a flaky connection, so
+// the download is retried once from scratch before giving up.
+func (s *Session) downloadVerifiedToFile(ctx context.Context, messageID string, media whatsmeow.DownloadableMessage, f *os.File) error {
+	err := s.client.DownloadToFile(ctx, media, f)
+	if !isMediaIntegrityError(err) {
+		return err
+	}
+	apiLog.Warnf("Media %s failed the integrity check, retrying the download: %v", messageID, err)
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to reset file for retry: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to reset file for retry: %w", err)
+	}
+	err = s.client.DownloadToFile(ctx, media, f)
+	if isMediaIntegrityError(err) {
+		apiLog.Errorf("Media %s failed the integrity check again: %v", messageID, err)
+	}
+	return err
+}
+
+// writeMediaSendError answers a media send that failed before reaching
+// WhatsApp with a 400 or 413, or hands other errors to writeOperationError.
+func writeMediaSendError(w http.ResponseWriter, message string, err error) {
+	switch {
+	case errors.Is(err, errInvalidMessage):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errMediaTooLarge):
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]interface{}{
+			"error":         err.Error(),
+			"maxMediaBytes": maxMediaBytes,
+		})
+	default:
+		writeOperationError(w, message, err)
+	}
+}
+
+// buildWaveform converts waveform samples to the byte form of AudioMessage.
+func buildWaveform(samples []int) ([]byte, error) {
+	if len(samples) > maxWaveformSamples {
+		return nil, fmt.Errorf("%w: waveform has more than %d samples", errInvalidMessage, maxWaveformSamples)
+	}
+	waveform := make([]byte, len(samples))
+	for i, sample := range samples {
+		if sample < 0 || sample > 100 {
+			return nil, fmt.Errorf("%w: waveform samples must be between 0 and 100", errInvalidMessage)
+		}
+		waveform[i] = byte(sample)
+	}
+	return waveform, nil
+}
+
+// handleSendAudio uploads audio and sends it, by default as a voice note.
+func handleSendAudio(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SendAudioRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok || !allowSend(w, jid) {
+		return
+	}
+	if req.Mimetype == "" {
+		req.Mimetype = "audio/ogg; codecs=opus"
+	} else if !strings.HasPrefix(req.Mimetype, "audio/") {
+		http.Error(w, "mimetype must be an audio type", http.StatusBadRequest)
+		return
+	}
+	ptt := req.PTT == nil || *req.PTT
+	waveform, err := buildWaveform(req.Waveform)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := decodeMediaData(req.Data)
+	if err != nil {
+		writeMediaSendError(w, "Failed to send audio", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	uploaded, err := sess.uploadMedia(ctx, jid, data, whatsmeow.MediaAudio)
+	if err != nil {
+		writeMediaSendError(w, "Failed to upload audio", err)
+		return
+	}
+	msg := &waProto.Message{
+		AudioMessage: &waProto.AudioMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(req.Mimetype),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			Seconds:       proto.Uint32(req.Seconds),
+			PTT:           proto.Bool(ptt),
+		},
+	}
+	if len(waveform) > 0 {
+		msg.AudioMessage.Waveform = waveform
+	}
+	resp, err := sess.sendMessage(ctx, jid, msg)
+	if err != nil {
+		writeOperationError(w, "Failed to send audio", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSendResult(jid, resp))
+}
+
+// SendStickerRequest is the body of POST /api/send/sticker. Data is a
+// base64-encoded WebP image; its dimensions are read from the image.
+type SendStickerRequest struct {
+	JID  string `json:"jid"`
+	Data string `json:"data"`
+}
+
+// webpInfo reads the dimensions of a WebP image and whether it is animated.
+// ok is false if data isn't a WebP image.
+func webpInfo(data []byte) (width, height uint32, animated, ok bool) {
+	if len(data) < 30 || !bytes.Equal(data[0:4], []byte("RIFF")) || !bytes.Equal(data[8:12], []byte("WEBP")) {
+		return 0, 0, false, false
+	}
+	switch string(data[12:16]) {
+	case "VP8X":
+		// Extended format: flags, then 24-bit canvas width-1 and height-1
+		animated = data[20]&0x02 != 0
+		width = (uint32(data[24]) | uint32(data[25])<<8 | uint32(data[26])<<16) + 1
+		height = (uint32(data[27]) | uint32(data[28])<<8 | uint32(data[29])<<16) + 1
+		return width, height, animated, true
+	case "VP8 ":
+		// Lossy: 3-byte frame tag and start code, then 14-bit dimensions
+		if !bytes.Equal(data[23:26], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, false, false
+		}
+		width = uint32(binary.LittleEndian.Uint16(data[26:28]) & 0x3fff)
+		height = uint32(binary.LittleEndian.Uint16(data[28:30]) & 0x3fff)
+		return width, height, false, true
+	case "VP8L":
+		// Lossless: signature byte, then 14-bit width-1 and height-1
+		if data[20] != 0x2f {
+			return 0, 0, false, false
+		}
+		bits := binary.LittleEndian.Uint32(data[21:25])
+		return bits&0x3fff + 1, (bits>>14)&0x3fff + 1, false, true
+	}
+	return 0, 0, false, false
+}
+
+// buildStickerMessage uploads a base64-encoded WebP image for a sticker
+// message to the given recipient.
+func (s *Session) buildStickerMessage(ctx context.Context, to types.JID, encoded string) (*waProto.Message, error) {
+	data, err := decodeMediaData(encoded)
+	if err != nil {
+		return nil, err
+	}
+	width, height, animated, isWebP := webpInfo(data)
+	if !isWebP {
+		return nil, fmt.Errorf("%w: stickers must be WebP images", errInvalidMessage)
+	}
+	uploaded, err := s.uploadMedia(ctx, to, data, whatsmeow.MediaImage)
+	if err != nil {
+		return nil, err
+	}
+	return &waProto.Message{
+		StickerMessage: &waProto.StickerMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String("image/webp"),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			Width:         proto.Uint32(width),
+			Height:        proto.Uint32(height),
+			IsAnimated:    proto.Bool(animated),
+		},
+	}, nil
+}
+
+// handleSendSticker uploads a WebP image and sends it as a sticker.
+func handleSendSticker(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SendStickerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok || !allowSend(w, jid) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	msg, err := sess.buildStickerMessage(ctx, jid, req.Data)
+	if err != nil {
+		writeMediaSendError(w, "Failed to upload sticker", err)
+		return
+	}
+	resp, err := sess.sendMessage(ctx, jid, msg)
+	if err != nil {
+		writeOperationError(w, "Failed to send sticker", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSendResult(jid, resp))
+}
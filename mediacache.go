@@ -0,0 +1,105 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// mediaCache remembers downloadable media messages by message ID so they can
+// be fetched through /api/download. Entries expire after ttl, and once
+// maxEntries is reached the oldest entries are evicted first.
+type mediaCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // oldest entry at the front
+}
+
+type mediaEntry struct {
+	id       string
+	media    interface{}
+	storedAt time.Time
+}
+
+func newMediaCache(ttl time.Duration, maxEntries int) *mediaCache {
+	return &mediaCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Store adds or refreshes the media for a message ID.
+func (c *mediaCache) Store(id string, media interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if elem, ok := c.entries[id]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[id] = c.order.PushBack(&mediaEntry{id: id, media: media, storedAt: now})
+	c.evictLocked(now)
+}
+
+// Load returns the media for a message ID if it is present and not expired.
+func (c *mediaCache) Load(id string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*mediaEntry)
+	if c.expired(entry, time.Now()) {
+		c.removeLocked(elem)
+		return nil, false
+	}
+	return entry.media, true
+}
+
+// Delete forgets the media for a message ID.
+func (c *mediaCache) Delete(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		c.removeLocked(elem)
+	}
+}
+
+// Len returns the number of cached entries, including expired ones that
+// haven't been evicted yet.
+func (c *mediaCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *mediaCache) expired(entry *mediaEntry, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(entry.storedAt) > c.ttl
+}
+
+// evictLocked drops expired entries and then the oldest entries until the
+// cache is within maxEntries. Entries are ordered by store time, so expired
+// entries are always at the front.
+func (c *mediaCache) evictLocked(now time.Time) {
+	for elem := c.order.Front(); elem != nil; elem = c.order.Front() {
+		if !c.expired(elem.Value.(*mediaEntry), now) {
+			break
+		}
+		c.removeLocked(elem)
+	}
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.removeLocked(c.order.Front())
+	}
+}
+
+func (c *mediaCache) removeLocked(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*mediaEntry).id)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served at GET /metrics.
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whatsapp_messages_received_total",
+		Help: "Incoming WhatsApp messages by content type.",
+	}, []string{"type"})
+	messagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whatsapp_messages_sent_total",
+		Help: "Messages sent to WhatsApp by result (success or error).",
+	}, []string{"result"})
+	agentPostFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "agent_post_failures_total",
+		Help: "Failed POST attempts to the agent, including attempts that are retried.",
+	})
+	mediaDownloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whatsapp_media_downloads_total",
+		Help: "Media downloads served by /api/download by result (success or error).",
+	}, []string{"result"})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "whatsapp_connected",
+		Help: "Whether the default session is connected to WhatsApp (1) or not (0).",
+	}, func() float64 {
+		if sess := sessions.Default(); sess != nil && sess.client.IsConnected() {
+			return 1
+		}
+		return 0
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "whatsapp_sessions_connected",
+		Help: "Number of sessions connected to WhatsApp.",
+	}, func() float64 {
+		connected := 0
+		for _, s := range sessions.All() {
+			if s.client.IsConnected() {
+				connected++
+			}
+		}
+		return float64(connected)
+	})
+)
+
+// resultLabel is the "result" label value for an operation's error.
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxLoggedBodyBytes caps how much of a request body is logged.
+const maxLoggedBodyBytes = 4096
+
+// redactedHeaders are never written to the access log.
+var redactedHeaders = []string{"Authorization", "X-Api-Key", "Cookie"}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush and Hijack pass through so streaming and upgraded connections keep
+// working behind the logger.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// accessLogMiddleware logs method, path, status and latency of every request.
+// At DEBUG the request headers are logged too, with credentials redacted, and
+// request bodies when LOG_MESSAGE_BODIES is set since they carry message text.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpLog.Debugf("%s %s headers: %s", r.Method, r.URL.Path, formatHeaders(r.Header))
+		if logMessageBodies && r.Body != nil {
+			body, _ := io.ReadAll(io.LimitReader(r.Body, maxLoggedBodyBytes))
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			if len(body) > 0 {
+				httpLog.Debugf("%s %s body: %s", r.Method, r.URL.Path, body)
+			}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Health probes hit the server every few seconds; keep them out of INFO
+		logf := httpLog.Infof
+		if r.URL.Path == "/health" || r.URL.Path == "/ready" {
+			logf = httpLog.Debugf
+		}
+		logf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	})
+}
+
+// CORS settings (ALLOWED_ORIGINS, CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS).
+// With no allowed origins browsers can't call the API cross-origin.
+var (
+	corsAllowedOrigins map[string]bool
+	corsAllowAnyOrigin bool
+	corsAllowedMethods string
+	corsAllowedHeaders string
+)
+
+// corsExposedHeaders lets browser clients read the headers downloads and
+// rate-limited sends rely on.
+const corsExposedHeaders = "Content-Length, Content-Range, Content-Disposition, Accept-Ranges, Retry-After"
+
+// configureCORS reads the CORS settings from the environment.
+func configureCORS() {
+	corsAllowedOrigins = make(map[string]bool)
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin == "*" {
+			corsAllowAnyOrigin = true
+		} else if origin != "" {
+			corsAllowedOrigins[origin] = true
+		}
+	}
+	corsAllowedMethods = envString("CORS_ALLOWED_METHODS", "GET, POST, DELETE, OPTIONS")
+	corsAllowedHeaders = envString("CORS_ALLOWED_HEADERS", "Content-Type, Authorization, X-Api-Key, Range")
+	if corsAllowAnyOrigin || len(corsAllowedOrigins) > 0 {
+		httpLog.Infof("Allowing cross-origin requests from %s", os.Getenv("ALLOWED_ORIGINS"))
+	}
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers their
+// preflight requests. It wraps the router so preflights never reach routes
+// that only accept GET or POST. Preflights from other origins get a 403;
+// their other requests are served without CORS headers, which makes the
+// browser withhold the response.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := corsAllowAnyOrigin || corsAllowedOrigins[origin]
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !allowed {
+			if preflight {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readCloser pairs a replacement body reader with the original body's Close.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// formatHeaders renders request headers for logging with credentials redacted.
+func formatHeaders(header http.Header) string {
+	redacted := header.Clone()
+	for _, name := range redactedHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, "[REDACTED]")
+		}
+	}
+	parts := make([]string, 0, len(redacted))
+	for name, values := range redacted {
+		parts = append(parts, name+"="+strings.Join(values, ","))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// WhatsApp clients accept polls with 2 to 12 options.
+const (
+	minPollOptions = 2
+	maxPollOptions = 12
+)
+
+// PollContent describes a poll, or for a "poll_vote" the options a voter
+// selected. A vote without SelectedOptions means the voter retracted it.
+type PollContent struct {
+	Question        string   `json:"question,omitempty"`
+	Options         []string `json:"options,omitempty"`
+	SelectableCount int      `json:"selectableCount,omitempty"`
+	SelectedOptions []string `json:"selectedOptions,omitempty"`
+}
+
+// SendPollRequest is the body of POST /api/send/poll. SelectableCount is the
+// number of options a voter may pick; 0 allows any number.
+type SendPollRequest struct {
+	JID             string   `json:"jid"`
+	Question        string   `json:"question"`
+	Options         []string `json:"options"`
+	SelectableCount int      `json:"selectableCount,omitempty"`
+}
+
+// PollVoteEvent is posted to the agent's /api/poll-vote when someone votes
+// on a poll. An empty SelectedOptions means the voter retracted the vote.
+type PollVoteEvent struct {
+	SessionID       string    `json:"sessionID,omitempty"`
+	PollMessageID   string    `json:"pollMessageID"`
+	VoteMessageID   string    `json:"voteMessageID"`
+	ChatJID         string    `json:"chatJID"`
+	VoterJID        string    `json:"voterJID"`
+	VoterName       string    `json:"voterName"`
+	Timestamp       time.Time `json:"timestamp"`
+	Question        string    `json:"question,omitempty"`
+	SelectedOptions []string  `json:"selectedOptions"`
+}
+
+// pollCreation returns the poll of a message in any of its protocol
+// versions, or nil.
+func pollCreation(msg *waProto.Message) *waProto.PollCreationMessage {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage()
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2()
+	case msg.GetPollCreationMessageV3() != nil:
+		return msg.GetPollCreationMessageV3()
+	}
+	return nil
+}
+
+// newPollContent converts a poll for the agent.
+func newPollContent(poll *waProto.PollCreationMessage) *PollContent {
+	content := &PollContent{
+		Question:        poll.GetName(),
+		SelectableCount: int(poll.GetSelectableOptionsCount()),
+	}
+	for _, option := range poll.GetOptions() {
+		content.Options = append(content.Options, option.GetOptionName())
+	}
+	return content
+}
+
+// pollVote decrypts a poll vote and maps the selected option hashes back to
+// option names using our stored copy of the poll. Options of polls we don't
+// have are reported as their hex-encoded hashes.
+func (s *Session) pollVote(v *events.Message) (*PollContent, error) {
+	vote, err := s.client.DecryptPollVote(context.Background(), v)
+	if err != nil {
+		return nil, err
+	}
+
+	pollID := v.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetID()
+	content := &PollContent{}
+	names := make(map[string]string)
+	if stored, err := loadStoredMessage(pollID); err != nil {
+		dbLog.Debugf("Poll %s not available to resolve vote options: %v", pollID, err)
+	} else if poll := pollCreation(stored); poll != nil {
+		content.Question = poll.GetName()
+		options := newPollContent(poll).Options
+		for i, hash := range whatsmeow.HashPollOptions(options) {
+			names[string(hash)] = options[i]
+		}
+	}
+	for _, hash := range vote.GetSelectedOptions() {
+		if name, ok := names[string(hash)]; ok {
+			content.SelectedOptions = append(content.SelectedOptions, name)
+		} else {
+			content.SelectedOptions = append(content.SelectedOptions, hex.EncodeToString(hash))
+		}
+	}
+	return content, nil
+}
+
+// forwardPollVote posts a decrypted vote to the agent's /api/poll-vote, so it
+// can tally votes without picking them out of /api/message.
+func forwardPollVote(agentMsg AgentMessage, poll *PollContent) {
+	selected := poll.SelectedOptions
+	if selected == nil {
+		selected = []string{}
+	}
+	forwardToAgentPath("/api/poll-vote", PollVoteEvent{
+		SessionID:       agentMsg.SessionID,
+		PollMessageID:   agentMsg.Content.TargetMessageID,
+		VoteMessageID:   agentMsg.MessageID,
+		ChatJID:         agentMsg.ChatJID,
+		VoterJID:        agentMsg.SenderJID,
+		VoterName:       agentMsg.SenderName,
+		Timestamp:       agentMsg.Timestamp,
+		Question:        poll.Question,
+		SelectedOptions: selected,
+	})
+}
+
+// buildPollMessage validates a poll and builds its creation message.
+func buildPollMessage(cli *whatsmeow.Client, req SendPollRequest) (*waProto.Message, error) {
+	question := strings.TrimSpace(req.Question)
+	if question == "" {
+		return nil, fmt.Errorf("%w: question is required", errInvalidMessage)
+	}
+	if len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		return nil, fmt.Errorf("%w: a poll needs %d to %d options", errInvalidMessage, minPollOptions, maxPollOptions)
+	}
+	// Votes identify options by a hash of their name, so names must be unique
+	seen := make(map[string]bool, len(req.Options))
+	for _, option := range req.Options {
+		if strings.TrimSpace(option) == "" {
+			return nil, fmt.Errorf("%w: poll options must not be empty", errInvalidMessage)
+		}
+		if seen[option] {
+			return nil, fmt.Errorf("%w: duplicate poll option %q", errInvalidMessage, option)
+		}
+		seen[option] = true
+	}
+	if req.SelectableCount < 0 || req.SelectableCount > len(req.Options) {
+		return nil, fmt.Errorf("%w: selectableCount must be between 0 and the number of options", errInvalidMessage)
+	}
+	return cli.BuildPollCreation(question, req.Options, req.SelectableCount), nil
+}
+
+func handleSendPoll(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SendPollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok || !allowSend(w, jid) {
+		return
+	}
+	msg, err := buildPollMessage(sess.client, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	resp, err := sess.sendMessage(ctx, jid, msg)
+	if err != nil {
+		writeOperationError(w, "Failed to send poll", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSendResult(jid, resp))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// PresenceSubscribeRequest is the body of POST /api/presence/subscribe.
+type PresenceSubscribeRequest struct {
+	JID string `json:"jid"`
+}
+
+// SetPresenceRequest is the body of POST /api/presence.
+type SetPresenceRequest struct {
+	Presence string `json:"presence"`
+}
+
+// ChatPresenceRequest is the body of POST /api/chatpresence. Media "audio"
+// shows "recording audio…" instead of "typing…" while composing.
+type ChatPresenceRequest struct {
+	JID   string `json:"jid"`
+	State string `json:"state"`
+	Media string `json:"media,omitempty"`
+}
+
+// PresenceEvent reports that a contact we subscribed to came online or went
+// offline, posted to the agent's /api/presence.
+type PresenceEvent struct {
+	SessionID string `json:"sessionID,omitempty"`
+	JID       string `json:"jid"`
+	Available bool   `json:"available"`
+	// LastSeen is only set when the contact shares it.
+	LastSeen     string `json:"lastSeen,omitempty"`
+	LastSeenUnix int64  `json:"lastSeenUnix,omitempty"`
+}
+
+// subscribePresence asks WhatsApp for presence updates of a user and
+// remembers the subscription, since it doesn't survive a reconnect.
+func (s *Session) subscribePresence(jid types.JID) error {
+	if err := s.client.SubscribePresence(jid); err != nil {
+		return err
+	}
+	s.presenceSubscriptions.Store(jid, struct{}{})
+	return nil
+}
+
+// resubscribePresence renews all presence subscriptions after a connect,
+// including the ones made by the reconnect loop.
+func (s *Session) resubscribePresence() {
+	s.presenceSubscriptions.Range(func(key, _ interface{}) bool {
+		jid := key.(types.JID)
+		if err := s.client.SubscribePresence(jid); err != nil {
+			eventLog.Warnf("Failed to renew presence subscription for %s: %v", jid, err)
+		}
+		return true
+	})
+}
+
+// presenceEvent converts a presence update for the agent.
+func presenceEvent(sessionID string, v *events.Presence) PresenceEvent {
+	evt := PresenceEvent{
+		SessionID: sessionID,
+		JID:       v.From.ToNonAD().String(),
+		Available: !v.Unavailable,
+	}
+	if !v.LastSeen.IsZero() {
+		evt.LastSeen = v.LastSeen.UTC().Format(time.RFC3339)
+		evt.LastSeenUnix = v.LastSeen.Unix()
+	}
+	return evt
+}
+
+// handlePresence forwards a presence update to the agent. It runs on the
+// session's dispatcher, so a slow agent doesn't hold up the event loop.
+func (s *Session) handlePresence(v *events.Presence) {
+	evt := presenceEvent(s.ID(), v)
+	eventLog.Debugf("Presence of %s: available=%t", evt.JID, evt.Available)
+	forwardToAgentPath("/api/presence", evt)
+}
+
+// handleSubscribePresence subscribes to a contact's presence. Updates are
+// posted to the agent's /api/presence.
+func handleSubscribePresence(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req PresenceSubscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jid, err := parseRecipient(req.JID)
+	if err == nil && jid.Server != types.DefaultUserServer && jid.Server != types.HiddenUserServer {
+		err = fmt.Errorf("%w: presence is only available for users, not %q", errInvalidRecipient, req.JID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := sess.subscribePresence(jid); err != nil {
+		writeOperationError(w, "Failed to subscribe to presence", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"jid": jid.String(), "status": "subscribed"})
+}
+
+// presenceEffects explains to API clients what each presence changes.
+var presenceEffects = map[types.Presence]string{
+	types.PresenceAvailable: "The account appears online. Contacts see typing indicators and read receipts as they happen, " +
+		"subscribed presence updates are delivered, and the phone stops getting notifications while the server is online.",
+	types.PresenceUnavailable: "The account appears offline with its last seen time. The phone gets notifications again, " +
+		"and WhatsApp stops delivering presence updates of subscribed contacts.",
+}
+
+// handleSetPresence marks the account as online ("available") or offline
+// ("unavailable") for all contacts.
+func handleSetPresence(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req SetPresenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	presence := types.Presence(req.Presence)
+	if presence != types.PresenceAvailable && presence != types.PresenceUnavailable {
+		http.Error(w, fmt.Sprintf("invalid presence %q, expected %q or %q", req.Presence, types.PresenceAvailable, types.PresenceUnavailable), http.StatusBadRequest)
+		return
+	}
+	if err := sess.client.SendPresence(presence); errors.Is(err, whatsmeow.ErrNoPushName) {
+		// WhatsApp sends the push name with the presence; it arrives with the
+		// app state sync shortly after pairing
+		http.Error(w, "Failed to set presence: the account's push name isn't known yet, try again later", http.StatusConflict)
+		return
+	} else if err != nil {
+		writeOperationError(w, "Failed to set presence", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"presence": req.Presence, "effects": presenceEffects[presence]})
+}
+
+// handleSetChatPresence shows or clears the typing indicator in a chat, e.g.
+// while the agent is generating a reply. WhatsApp clears "composing" by
+// itself after a while and when the message is sent.
+func handleSetChatPresence(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req ChatPresenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	state := types.ChatPresence(req.State)
+	if state != types.ChatPresenceComposing && state != types.ChatPresencePaused {
+		http.Error(w, fmt.Sprintf("invalid state %q, expected %q or %q", req.State, types.ChatPresenceComposing, types.ChatPresencePaused), http.StatusBadRequest)
+		return
+	}
+	media := types.ChatPresenceMedia(req.Media)
+	if media != types.ChatPresenceMediaText && media != types.ChatPresenceMediaAudio {
+		http.Error(w, fmt.Sprintf("invalid media %q, expected %q or none", req.Media, types.ChatPresenceMediaAudio), http.StatusBadRequest)
+		return
+	}
+	jid, ok := resolveRecipientOrError(w, sess, req.JID)
+	if !ok {
+		return
+	}
+	if err := sess.client.SendChatPresence(jid, state, media); err != nil {
+		writeOperationError(w, "Failed to set chat presence", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"jid": jid.String(), "state": req.State})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestPresenceEvent(t *testing.T) {
+	device := types.JID{User: "919812345678", Device: 3, Server: types.DefaultUserServer}
+	lastSeen := time.Date(2025, 6, 1, 12, 30, 0, 0, time.FixedZone("IST", 5*3600+1800))
+	tests := []struct {
+		name string
+		in   events.Presence
+		want PresenceEvent
+	}{
+		{
+			name: "online",
+			in:   events.Presence{From: device},
+			want: PresenceEvent{SessionID: "1", JID: "919812345678@s.whatsapp.net", Available: true},
+		},
+		{
+			name: "offline with last seen",
+			in:   events.Presence{From: device, Unavailable: true, LastSeen: lastSeen},
+			want: PresenceEvent{
+				SessionID:    "1",
+				JID:          "919812345678@s.whatsapp.net",
+				LastSeen:     "2025-06-01T07:00:00Z",
+				LastSeenUnix: lastSeen.Unix(),
+			},
+		},
+		{
+			name: "offline with hidden last seen",
+			in:   events.Presence{From: device, Unavailable: true},
+			want: PresenceEvent{SessionID: "1", JID: "919812345678@s.whatsapp.net"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := presenceEvent("1", &tt.in); got != tt.want {
+				t.Errorf("presenceEvent() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Send limiters; each is nil when disabled.
+var (
+	// chatSendLimiter limits sends per chat (SEND_RATE_PER_MINUTE, SEND_BURST).
+	chatSendLimiter *rateLimiter
+	// globalSendLimiter limits sends across all chats
+	// (GLOBAL_SEND_RATE_PER_MINUTE, GLOBAL_SEND_BURST).
+	globalSendLimiter *rateLimiter
+	// recipientCooldown enforces a minimum gap between two sends to the same
+	// chat (SEND_COOLDOWN).
+	recipientCooldown *rateLimiter
+)
+
+// rateLimiterSweepSize is the number of tracked keys above which idle buckets
+// are dropped.
+const rateLimiterSweepSize = 1000
+
+// rateLimiter is a token bucket per key: each key may spend up to burst
+// tokens at once, refilled at rate tokens per second.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute events per key with
+// bursts of up to burst events, or nil when perMinute is 0.
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return newTokenLimiter(float64(perMinute)/60, burst)
+}
+
+// newCooldownLimiter returns a limiter allowing one event per key every
+// cooldown, or nil when cooldown is 0.
+func newCooldownLimiter(cooldown time.Duration) *rateLimiter {
+	if cooldown <= 0 {
+		return nil
+	}
+	return newTokenLimiter(1/cooldown.Seconds(), 1)
+}
+
+func newTokenLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Reserve takes a token for key. It returns 0 when the event is allowed, or
+// how long to wait until a token is available. A nil limiter allows
+// everything.
+func (l *rateLimiter) Reserve(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > rateLimiterSweepSize {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// Refund returns a token taken by Reserve, for when a later check vetoed the
+// event.
+func (l *rateLimiter) Refund(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+}
+
+// sweep drops buckets that have refilled completely; they behave exactly
+// like new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds for Retry-After.
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// reserveSend takes a token from each send limiter for a send to chat. When
+// any of them is exhausted it returns how long to wait and takes no tokens.
+func reserveSend(chat types.JID) time.Duration {
+	checks := []struct {
+		limiter *rateLimiter
+		key     string
+	}{
+		{recipientCooldown, chat.String()},
+		{chatSendLimiter, chat.String()},
+		{globalSendLimiter, ""},
+	}
+	for i, check := range checks {
+		if wait := check.limiter.Reserve(check.key); wait > 0 {
+			for _, taken := range checks[:i] {
+				taken.limiter.Refund(taken.key)
+			}
+			return wait
+		}
+	}
+	return 0
+}
+
+// allowSend checks the send limits, answering with a 429 and the seconds to
+// wait when a send to chat would exceed them.
+func allowSend(w http.ResponseWriter, chat types.JID) bool {
+	wait := reserveSend(chat)
+	if wait == 0 {
+		return true
+	}
+	retryAfter := retryAfterSeconds(wait)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"error":      "send rate limit exceeded for " + chat.String(),
+		"retryAfter": retryAfter,
+	})
+	return false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Delivery states of a sent message, in the order they progress. Stored
+// messages without a state were sent but not yet acknowledged.
+const (
+	statusSent      = "sent"
+	statusDelivered = "delivered"
+	statusRead      = "read"
+	statusPlayed    = "played"
+)
+
+// statusRankSQL orders the delivery states so that an update never moves a
+// message back, e.g. when a delivery receipt arrives after the read receipt.
+const statusRankSQL = "CASE status WHEN 'delivered' THEN 2 WHEN 'read' THEN 3 WHEN 'played' THEN 4 ELSE 1 END"
+
+// ReceiptEvent reports that messages we sent were delivered, read or played,
+// posted to the agent's /api/receipt.
+type ReceiptEvent struct {
+	SessionID     string   `json:"sessionID,omitempty"`
+	ChatJID       string   `json:"chatJID"`
+	SenderJID     string   `json:"senderJID"`
+	MessageIDs    []string `json:"messageIDs"`
+	Status        string   `json:"status"`
+	Timestamp     string   `json:"timestamp"`
+	TimestampUnix int64    `json:"timestampUnix"`
+}
+
+// receiptStatus maps a receipt type to the delivery state it acknowledges.
+// Other receipts, e.g. our own devices marking messages read, are ignored.
+func receiptStatus(t types.ReceiptType) (string, bool) {
+	switch t {
+	case types.ReceiptTypeDelivered:
+		return statusDelivered, true
+	case types.ReceiptTypeRead:
+		return statusRead, true
+	case types.ReceiptTypePlayed:
+		return statusPlayed, true
+	}
+	return "", false
+}
+
+// statusRank returns the position of a delivery state in statusRankSQL.
+func statusRank(status string) int {
+	switch status {
+	case statusDelivered:
+		return 2
+	case statusRead:
+		return 3
+	case statusPlayed:
+		return 4
+	}
+	return 1
+}
+
+// handleReceipt records delivery and read receipts for messages we sent and
+// forwards them to the agent. In groups every member sends receipts, so the
+// stored status is the furthest state any member reached. It runs on the
+// session's dispatcher, like handleMessage.
+func (s *Session) handleReceipt(v *events.Receipt) {
+	status, ok := receiptStatus(v.Type)
+	if !ok || v.IsFromMe {
+		return
+	}
+	if err := updateMessageStatus(receiptChats(v), v.MessageIDs, status); err != nil {
+		dbLog.Errorf("Failed to update status of messages %v: %v", v.MessageIDs, err)
+	}
+	eventLog.Debugf("Messages %v in %s %s by %s", v.MessageIDs, v.Chat, status, v.Sender)
+	forwardToAgentPath("/api/receipt", ReceiptEvent{
+		SessionID:     s.ID(),
+		ChatJID:       v.Chat.String(),
+		SenderJID:     v.Sender.ToNonAD().String(),
+		MessageIDs:    v.MessageIDs,
+		Status:        status,
+		Timestamp:     v.Timestamp.Format(time.RFC3339),
+		TimestampUnix: v.Timestamp.Unix(),
+	})
+}
+
+// updateMessageStatus advances the delivery state of messages we sent in
+// one of chats. Messages already in the same or a later state are left
+// alone, as are received messages and messages of other chats, so a receipt
+// can't change messages it doesn't refer to.
+func updateMessageStatus(chats []types.JID, ids []types.MessageID, status string) error {
+	if db == nil {
+		return fmt.Errorf("database connection is not initialized")
+	}
+	if len(ids) == 0 || len(chats) == 0 {
+		return nil
+	}
+	idPlaceholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	chatPlaceholders := strings.TrimSuffix(strings.Repeat("?,", len(chats)), ",")
+	args := []interface{}{status}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	for _, chat := range chats {
+		args = append(args, chat.String())
+	}
+	args = append(args, statusRank(status))
+	_, err := db.Exec("UPDATE messages SET status = ? WHERE message_id IN ("+idPlaceholders+") AND from_me = 1 AND chat_jid IN ("+chatPlaceholders+") AND "+statusRankSQL+" < ?", args...)
+	if err != nil {
+		return fmt.Errorf("failed to update message status: %w", err)
+	}
+	return nil
+}
+
+// receiptChats returns the addresses a receipt's chat may be stored under.
+// Receipts in direct chats may name the chat by the contact's LID rather
+// than the phone number the message was sent to, or the other way around,
+// so the sender's alternate address is included for those.
+func receiptChats(v *events.Receipt) []types.JID {
+	chats := []types.JID{v.Chat.ToNonAD()}
+	if !v.IsGroup && !v.SenderAlt.IsEmpty() {
+		chats = append(chats, v.SenderAlt.ToNonAD())
+	}
+	return chats
+}
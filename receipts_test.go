@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestReceiptStatus(t *testing.T) {
+	tests := []struct {
+		receipt types.ReceiptType
+		status  string
+		ok      bool
+	}{
+		{types.ReceiptTypeDelivered, statusDelivered, true},
+		{types.ReceiptTypeRead, statusRead, true},
+		{types.ReceiptTypePlayed, statusPlayed, true},
+		{types.ReceiptTypeReadSelf, "", false},
+		{types.ReceiptTypePlayedSelf, "", false},
+		{types.ReceiptTypeSender, "", false},
+		{types.ReceiptTypeRetry, "", false},
+	}
+	for _, tt := range tests {
+		status, ok := receiptStatus(tt.receipt)
+		if status != tt.status || ok != tt.ok {
+			t.Errorf("receiptStatus(%q) = %q, %t; want %q, %t", tt.receipt, status, ok, tt.status, tt.ok)
+		}
+	}
+}
+
+func TestStatusRankOrder(t *testing.T) {
+	order := []string{statusSent, statusDelivered, statusRead, statusPlayed}
+	for i := 1; i < len(order); i++ {
+		if statusRank(order[i-1]) >= statusRank(order[i]) {
+			t.Errorf("statusRank(%q) = %d, want less than statusRank(%q) = %d",
+				order[i-1], statusRank(order[i-1]), order[i], statusRank(order[i]))
+		}
+	}
+	if got := statusRank(""); got != statusRank(statusSent) {
+		t.Errorf("statusRank(\"\") = %d, want the rank of %q", got, statusSent)
+	}
+}
+
+func TestUpdateMessageStatus(t *testing.T) {
+	withMessagesDB(t)
+	me := types.NewJID("919800000000", types.DefaultUserServer)
+	alice := types.NewJID("919811111111", types.DefaultUserServer)
+	aliceLID := types.NewJID("111111111", types.HiddenUserServer)
+	bob := types.NewJID("919822222222", types.DefaultUserServer)
+	storeTestMessage(t, "sent", alice, me, true, "hi")
+	storeTestMessage(t, "received", alice, alice, false, "hello")
+	storeTestMessage(t, "to-bob", bob, me, true, "hey")
+
+	// Alice's receipt names her LID and, as the sender's alternate, her number
+	receipt := &events.Receipt{MessageSource: types.MessageSource{Chat: aliceLID, Sender: aliceLID, SenderAlt: alice}}
+	if err := updateMessageStatus(receiptChats(receipt), []types.MessageID{"sent", "received", "to-bob"}, statusRead); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"sent": statusRead, "received": nil, "to-bob": statusSent}
+	for id, status := range want {
+		msg, err := getMessage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg["status"] != status {
+			t.Errorf("status of %s = %v, want %v", id, msg["status"], status)
+		}
+	}
+
+	// Receipts never move a message back
+	if err := updateMessageStatus([]types.JID{alice}, []types.MessageID{"sent"}, statusDelivered); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := getMessage("sent"); msg["status"] != statusRead {
+		t.Errorf("status after a late delivery receipt = %v, want %s", msg["status"], statusRead)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// verifyRecipients makes sends check that a user recipient is registered on
+// WhatsApp before sending (VERIFY_RECIPIENTS).
+var verifyRecipients bool
+
+var (
+	// errInvalidRecipient is returned when a recipient is neither a phone
+	// number nor a JID we can send to.
+	errInvalidRecipient = errors.New("invalid recipient")
+	// errNotOnWhatsApp is returned when a verified number isn't registered.
+	errNotOnWhatsApp = errors.New("number is not on WhatsApp")
+	// errNotNewsletterAdmin is returned when sending to a channel the account
+	// can't post in.
+	errNotNewsletterAdmin = errors.New("account is not an admin of the channel")
+)
+
+// parseRecipient normalizes a recipient given as a phone number ("+91 98123
+// 45678") or a JID into a JID. Bare numbers become user JIDs, and user and
+// group JIDs are checked for a plausible user part.
+func parseRecipient(raw string) (types.JID, error) {
+	if strings.TrimSpace(raw) == "" {
+		return types.JID{}, fmt.Errorf("%w: jid is required", errInvalidRecipient)
+	}
+	if !strings.Contains(raw, "@") {
+		number := phoneNumberFormatting.Replace(raw)
+		if !isPhoneNumber(number) {
+			return types.JID{}, fmt.Errorf("%w: %q is not a phone number (expected 7-15 digits including the country code)", errInvalidRecipient, raw)
+		}
+	}
+
+	jid, err := types.ParseJID(normalizeJID(raw))
+	if err != nil {
+		return types.JID{}, fmt.Errorf("%w: %q is not a valid JID", errInvalidRecipient, raw)
+	}
+	switch jid.Server {
+	case types.DefaultUserServer, types.LegacyUserServer:
+		if !isPhoneNumber(jid.User) {
+			return types.JID{}, fmt.Errorf("%w: %q does not contain a valid phone number", errInvalidRecipient, raw)
+		}
+		jid.Server = types.DefaultUserServer
+	case types.GroupServer:
+		if jid.User == "" || strings.Trim(jid.User, "0123456789-") != "" {
+			return types.JID{}, fmt.Errorf("%w: %q is not a valid group JID", errInvalidRecipient, raw)
+		}
+	case types.NewsletterServer:
+		if jid.User == "" || strings.Trim(jid.User, "0123456789") != "" {
+			return types.JID{}, fmt.Errorf("%w: %q is not a valid channel JID", errInvalidRecipient, raw)
+		}
+	case types.HiddenUserServer:
+		if jid.User == "" {
+			return types.JID{}, fmt.Errorf("%w: %q is not a valid JID", errInvalidRecipient, raw)
+		}
+	default:
+		return types.JID{}, fmt.Errorf("%w: unsupported server %q in %q (use @%s for users, @%s for groups or @%s for channels)",
+			errInvalidRecipient, jid.Server, raw, types.DefaultUserServer, types.GroupServer, types.NewsletterServer)
+	}
+	return jid, nil
+}
+
+// phoneNumberFormatting strips the characters people use to format phone
+// numbers ("+91 (98123) 456-78").
+var phoneNumberFormatting = strings.NewReplacer("+", "", " ", "", "-", "", "(", "", ")", "")
+
+// normalizeJID cleans up a user-supplied JID: formatting is stripped from
+// phone numbers and the default user server is appended when no server is
+// given. Group JIDs keep their "-" separated user part.
+func normalizeJID(raw string) string {
+	raw = strings.TrimSpace(raw)
+	user, server, found := strings.Cut(raw, "@")
+	if !found {
+		return phoneNumberFormatting.Replace(raw) + "@" + types.DefaultUserServer
+	}
+	if server == types.GroupServer {
+		return strings.ReplaceAll(user, " ", "") + "@" + server
+	}
+	return phoneNumberFormatting.Replace(user) + "@" + server
+}
+
+// isPhoneNumber reports whether s looks like an international phone number
+// without the leading "+".
+func isPhoneNumber(s string) bool {
+	if len(s) < 7 || len(s) > 15 {
+		return false
+	}
+	return strings.Trim(s, "0123456789") == ""
+}
+
+// resolveRecipient parses a recipient and checks that channel recipients
+// are channels the account can post in. When verifyRecipients is set, user
+// recipients are also checked to be registered on WhatsApp.
+func (s *Session) resolveRecipient(raw string) (types.JID, error) {
+	jid, err := parseRecipient(raw)
+	if err != nil {
+		return jid, err
+	}
+	if jid.Server == types.NewsletterServer {
+		return jid, s.checkNewsletterAdmin(jid)
+	}
+	if !verifyRecipients || jid.Server != types.DefaultUserServer {
+		return jid, nil
+	}
+	resp, err := s.client.IsOnWhatsApp([]string{"+" + jid.User})
+	if err != nil {
+		return types.JID{}, fmt.Errorf("failed to check %s on WhatsApp: %w", jid.User, err)
+	}
+	if len(resp) == 0 || !resp[0].IsIn {
+		return types.JID{}, fmt.Errorf("%w: %s", errNotOnWhatsApp, jid.User)
+	}
+	return resp[0].JID, nil
+}
+
+// checkNewsletterAdmin returns an error wrapping errNotNewsletterAdmin
+// unless the account owns or administers the channel. WhatsApp silently
+// drops posts from anyone else.
+func (s *Session) checkNewsletterAdmin(jid types.JID) error {
+	info, err := s.client.GetNewsletterInfo(jid)
+	if err != nil {
+		return fmt.Errorf("failed to fetch channel info for %s: %w", jid, err)
+	}
+	if info.ViewerMeta == nil {
+		return fmt.Errorf("%w: %s", errNotNewsletterAdmin, jid)
+	}
+	switch info.ViewerMeta.Role {
+	case types.NewsletterRoleOwner, types.NewsletterRoleAdmin:
+		return nil
+	}
+	return fmt.Errorf("%w: %s (role: %s)", errNotNewsletterAdmin, jid, info.ViewerMeta.Role)
+}
+
+// isRecipientError reports whether err is the caller's fault and should be
+// answered with a 400.
+func isRecipientError(err error) bool {
+	return errors.Is(err, errInvalidRecipient) || errors.Is(err, errNotOnWhatsApp)
+}
+
+// maxOnWhatsAppPhones caps the numbers checked by one /api/onwhatsapp call.
+const maxOnWhatsAppPhones = 100
+
+// OnWhatsAppRequest is the body of POST /api/onwhatsapp.
+type OnWhatsAppRequest struct {
+	Phones []string `json:"phones"`
+}
+
+// OnWhatsAppResult reports whether a single phone number is registered.
+type OnWhatsAppResult struct {
+	Phone        string `json:"phone"`
+	IsOnWhatsApp bool   `json:"isOnWhatsApp"`
+	JID          string `json:"jid,omitempty"`
+	BusinessName string `json:"businessName,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// handleOnWhatsApp checks which of the given phone numbers are registered on
+// WhatsApp, so callers can tell whether a number is reachable before sending.
+func handleOnWhatsApp(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req OnWhatsAppRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Phones) == 0 {
+		http.Error(w, "phones is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Phones) > maxOnWhatsAppPhones {
+		http.Error(w, fmt.Sprintf("at most %d phones can be checked at once", maxOnWhatsAppPhones), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]OnWhatsAppResult, len(req.Phones))
+	var queries []string
+	for i, phone := range req.Phones {
+		results[i].Phone = phone
+		number := phoneNumberFormatting.Replace(strings.TrimSpace(phone))
+		if !isPhoneNumber(number) {
+			results[i].Error = "not a phone number (expected 7-15 digits including the country code)"
+			continue
+		}
+		queries = append(queries, "+"+number)
+	}
+	if len(queries) > 0 {
+		resp, err := sess.client.IsOnWhatsApp(queries)
+		if err != nil {
+			http.Error(w, "Failed to check numbers: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		registered := make(map[string]types.IsOnWhatsAppResponse, len(resp))
+		for _, info := range resp {
+			registered[strings.TrimPrefix(info.Query, "+")] = info
+		}
+		for i := range results {
+			if results[i].Error != "" {
+				continue
+			}
+			info, found := registered[phoneNumberFormatting.Replace(strings.TrimSpace(results[i].Phone))]
+			if !found || !info.IsIn {
+				continue
+			}
+			results[i].IsOnWhatsApp = true
+			results[i].JID = info.JID.String()
+			if info.VerifiedName != nil && info.VerifiedName.Details != nil {
+				results[i].BusinessName = info.VerifiedName.Details.GetVerifiedName()
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
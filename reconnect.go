@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Backoff between reconnect attempts of a dropped session: it starts at
+// reconnectMinBackoff (RECONNECT_MIN_BACKOFF) and doubles after every failed
+// attempt up to reconnectMaxBackoff (RECONNECT_MAX_BACKOFF).
+var (
+	reconnectMinBackoff = 2 * time.Second
+	reconnectMaxBackoff = 5 * time.Minute
+)
+
+// startReconnect starts reconnecting a paired session whose connection was
+// lost, unless it is already reconnecting. whatsmeow's own auto-reconnect is
+// disabled, so this loop is the only thing that reconnects sessions.
+func (s *Session) startReconnect() {
+	s.reconnectMu.Lock()
+	defer s.reconnectMu.Unlock()
+	if s.reconnectCancel != nil || s.ID() == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.reconnectCancel = cancel
+	s.reconnecting.Store(true)
+	go s.reconnectLoop(ctx)
+}
+
+// stopReconnect ends the reconnect loop, once the session is connected again
+// or has been logged out.
+func (s *Session) stopReconnect() {
+	s.reconnectMu.Lock()
+	defer s.reconnectMu.Unlock()
+	if s.reconnectCancel != nil {
+		s.reconnectCancel()
+		s.reconnectCancel = nil
+	}
+	s.reconnecting.Store(false)
+}
+
+// reconnectLoop tries to connect with exponential backoff until the
+// Connected event stops it. A successful Connect only opens the socket, so
+// the loop keeps waiting while the client is connected but not yet logged
+// in, and tries again if that connection drops too.
+func (s *Session) reconnectLoop(ctx context.Context) {
+	backoff := reconnectMinBackoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if s.ID() == "" {
+			// Logged out in the meantime, there is nothing to reconnect
+			s.stopReconnect()
+			return
+		}
+		if !s.client.IsConnected() {
+			s.reconnectAttempt(ctx, attempt)
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+func (s *Session) reconnectAttempt(ctx context.Context, attempt int) {
+	// Hold loginMu so a logout can't interleave with the attempt
+	s.loginMu.Lock()
+	defer s.loginMu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	eventLog.Infof("Reconnecting session %s (attempt %d)", s.ID(), attempt)
+	s.postStatus(map[string]string{"status": "reconnecting", "session": s.ID()})
+	if err := s.client.Connect(); err != nil && !errors.Is(err, whatsmeow.ErrAlreadyConnected) {
+		eventLog.Warnf("Reconnecting session %s failed: %v", s.ID(), err)
+	}
+}
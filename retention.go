@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// retentionPeriod is how long stored messages are kept (RETENTION_DAYS);
+	// 0 keeps them forever.
+	retentionPeriod time.Duration
+	// retentionKeepPerChat is the number of most recent messages kept in
+	// every chat regardless of age.
+	retentionKeepPerChat int
+	retentionInterval    time.Duration
+	retentionBatchSize   int
+)
+
+// configureRetention reads the retention settings from the environment.
+func configureRetention() {
+	retentionPeriod = time.Duration(envInt("RETENTION_DAYS", 0)) * 24 * time.Hour
+	retentionKeepPerChat = envInt("RETENTION_KEEP_PER_CHAT", 0)
+	retentionInterval = envDuration("RETENTION_INTERVAL", time.Hour)
+	retentionBatchSize = envInt("RETENTION_BATCH_SIZE", 500)
+	if retentionInterval <= 0 {
+		retentionInterval = time.Hour
+	}
+	if retentionBatchSize <= 0 {
+		retentionBatchSize = 500
+	}
+}
+
+// pruneMessagesPeriodically runs pruneMessages on startup and then on every
+// tick of RETENTION_INTERVAL. It does nothing when retention is disabled.
+func pruneMessagesPeriodically() {
+	if retentionPeriod <= 0 {
+		return
+	}
+	dbLog.Infof("Pruning messages older than %s every %s (keeping the latest %d per chat)", retentionPeriod, retentionInterval, retentionKeepPerChat)
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		cutoff := time.Now().Add(-retentionPeriod)
+		removed, err := pruneMessages(cutoff, retentionKeepPerChat, retentionBatchSize)
+		if err != nil {
+			dbLog.Errorf("Failed to prune messages: %v", err)
+		}
+		if removed > 0 {
+			dbLog.Infof("Pruned %d messages older than %s", removed, cutoff.Format(time.RFC3339))
+		}
+		<-ticker.C
+	}
+}
+
+// pruneMessages deletes messages stored before cutoff, except the keep most
+// recent ones of each chat. Rows are deleted batchSize at a time so that no
+// single transaction holds the write lock for long. It returns the number of
+// messages removed.
+func pruneMessages(cutoff time.Time, keep, batchSize int) (int, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database connection is not initialized")
+	}
+	total := 0
+	for {
+		ids, err := expiredMessageIDs(cutoff.Unix(), keep, batchSize)
+		if err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+		args := make([]interface{}, len(ids))
+		for i, id := range ids {
+			args[i] = id
+		}
+		res, err := db.Exec("DELETE FROM messages WHERE message_id IN ("+placeholders+")", args...)
+		if err != nil {
+			return total, fmt.Errorf("failed to delete messages: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("failed to read affected rows: %w", err)
+		}
+		total += int(affected)
+		for _, id := range ids {
+			removeSavedMedia(id)
+		}
+		if len(ids) < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// expiredMessageIDs returns up to limit IDs of messages stored before cutoff
+// that aren't among the keep most recent messages of their chat.
+func expiredMessageIDs(cutoff int64, keep, limit int) ([]string, error) {
+	query := "SELECT message_id FROM messages WHERE timestamp < ? LIMIT ?"
+	args := []interface{}{cutoff, limit}
+	if keep > 0 {
+		query = `SELECT message_id FROM (
+			SELECT message_id, timestamp,
+				ROW_NUMBER() OVER (PARTITION BY chat_jid ORDER BY timestamp DESC) AS recency
+			FROM messages
+		) ranked WHERE timestamp < ? AND recency > ? LIMIT ?`
+		args = []interface{}{cutoff, keep, limit}
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired messages: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to read expired message: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
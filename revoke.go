@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// OwnMessageRequest names one of our sent messages, for POST /api/delete.
+type OwnMessageRequest struct {
+	JID       string `json:"jid"`
+	MessageID string `json:"messageID"`
+}
+
+// ownMessageOrError looks up a stored message the session's account sent in
+// the given chat. It answers with a 400 for invalid chats, a 404 for unknown
+// messages or messages of another chat, a 403 for messages sent by someone
+// else, including our other sessions, and a 409 for messages already
+// deleted.
+func ownMessageOrError(w http.ResponseWriter, sess *Session, rawChat, messageID string) (types.JID, map[string]interface{}, bool) {
+	chat, err := parseRecipient(rawChat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return types.JID{}, nil, false
+	}
+	if messageID == "" {
+		http.Error(w, "messageID is required", http.StatusBadRequest)
+		return types.JID{}, nil, false
+	}
+	message, err := getMessage(messageID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve message: "+err.Error(), http.StatusInternalServerError)
+		return types.JID{}, nil, false
+	}
+	if message == nil || message["chat"] != chat.String() {
+		http.Error(w, "Message not found in this chat", http.StatusNotFound)
+		return types.JID{}, nil, false
+	}
+	sender, _ := message["sender"].(string)
+	if senderJID, _ := types.ParseJID(sender); !sess.ownsUser(senderJID.User) {
+		http.Error(w, "Only messages sent by this account can be changed", http.StatusForbidden)
+		return types.JID{}, nil, false
+	}
+	if deleted, _ := message["deleted"].(bool); deleted {
+		http.Error(w, "Message was already deleted", http.StatusConflict)
+		return types.JID{}, nil, false
+	}
+	return chat, message, true
+}
+
+// handleDeleteMessage deletes one of our messages for everyone in the chat.
+func handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req OwnMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chat, _, ok := ownMessageOrError(w, sess, req.JID, req.MessageID)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), sendTimeout)
+	defer cancel()
+	// The revoke itself isn't a chat message, so it isn't stored
+	resp, err := sess.client.SendMessage(ctx, chat, sess.client.BuildRevoke(chat, types.EmptyJID, req.MessageID))
+	if err != nil {
+		writeOperationError(w, "Failed to delete message", err)
+		return
+	}
+	// WhatsApp doesn't echo our own revoke back, so update the history here
+	if err := markMessageDeleted(req.MessageID, chat, time.Now()); err != nil {
+		dbLog.Errorf("Failed to mark message %s as deleted: %v", req.MessageID, err)
+	} else {
+		mediaMap.Delete(req.MessageID)
+		removeSavedMedia(req.MessageID)
+	}
+	writeJSON(w, http.StatusOK, newSendResult(chat, resp))
+}
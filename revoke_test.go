@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestCheckRevoke(t *testing.T) {
+	withMessagesDB(t)
+	alice := types.NewJID("919811111111", types.DefaultUserServer)
+	bob := types.NewJID("919822222222", types.DefaultUserServer)
+	group := types.NewJID("120363000000000001", types.GroupServer)
+	storeTestMessage(t, "dm", alice, types.NewADJID(alice.User, 0, 2), false, "hi")
+	storeTestMessage(t, "grp", group, alice, false, "hello")
+
+	s := &Session{}
+	tests := []struct {
+		name    string
+		msgID   string
+		info    types.MessageInfo
+		wantErr error
+	}{
+		{name: "sender", msgID: "dm", info: messageInfo(alice, alice)},
+		{name: "sender by LID", msgID: "dm", info: types.MessageInfo{MessageSource: types.MessageSource{
+			Chat: alice, Sender: types.NewJID("111111111", types.HiddenUserServer), SenderAlt: alice,
+		}}},
+		{name: "someone else", msgID: "dm", info: messageInfo(alice, bob), wantErr: errNotMessageSender},
+		{name: "other chat", msgID: "dm", info: messageInfo(bob, alice), wantErr: errMessageNotFound},
+		{name: "group message from another chat", msgID: "grp", info: messageInfo(alice, alice), wantErr: errMessageNotFound},
+		{name: "group sender", msgID: "grp", info: messageInfo(group, alice)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.checkRevoke(tt.msgID, tt.info)
+			if tt.wantErr == nil && err != nil {
+				t.Fatal(err)
+			} else if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMarkMessageDeleted(t *testing.T) {
+	withMessagesDB(t)
+	alice := types.NewJID("919811111111", types.DefaultUserServer)
+	bob := types.NewJID("919822222222", types.DefaultUserServer)
+	storeTestMessage(t, "m1", alice, alice, false, "hi")
+
+	if err := markMessageDeleted("m1", bob, time.Now()); !errors.Is(err, errMessageNotFound) {
+		t.Fatalf("deleting from another chat: err = %v, want errMessageNotFound", err)
+	}
+	if _, err := loadStoredMessage("m1"); err != nil {
+		t.Fatalf("message deleted from another chat: %v", err)
+	}
+	if err := markMessageDeleted("m1", alice, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadStoredMessage("m1"); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("deleted message still loads: %v", err)
+	}
+	if err := markMessageDeleted("m1", alice, time.Now()); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("deleting twice: err = %v, want errMessageNotFound", err)
+	}
+}
+
+// messageInfo returns the info of a message sender sent in chat.
+func messageInfo(chat, sender types.JID) types.MessageInfo {
+	return types.MessageInfo{MessageSource: types.MessageSource{Chat: chat, Sender: sender}}
+}
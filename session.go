@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Session is one linked WhatsApp account served by this process. Each
+// session has its own client and message workers; the database, media cache
+// and agent delivery are shared.
+type Session struct {
+	client     *whatsmeow.Client
+	dispatcher *eventDispatcher
+	// loginMu serializes login and logout so two requests can't race to pair.
+	loginMu sync.Mutex
+	// reconnecting is set while the session is reconnecting after a dropped
+	// connection; reconnectCancel stops the reconnect loop.
+	reconnecting    atomic.Bool
+	reconnectMu     sync.Mutex
+	reconnectCancel context.CancelFunc
+	// loggingOut is set while a logout is tearing the session down.
+	loggingOut atomic.Bool
+	// qrCode is the current pairing code while a QR login is in progress.
+	qrCode atomic.Value // string
+	// lastConnected is the Unix time of the last successful connect, 0 if
+	// the session hasn't connected yet.
+	lastConnected atomic.Int64
+	// presenceSubscriptions holds the JIDs subscribed to with
+	// POST /api/presence/subscribe, renewed on every connect.
+	presenceSubscriptions sync.Map // types.JID -> struct{}
+	// jid and lid cache the account's device JID and LID. whatsmeow sets
+	// and clears Store.ID from its own goroutines when pairing and logging
+	// out, so the session reads these instead.
+	jidMu sync.RWMutex
+	jid   types.JID
+	lid   types.JID
+}
+
+// newSession creates a session for a device from the store container. It
+// doesn't connect; use Connect or startQRLogin for that.
+func newSession(device *store.Device) *Session {
+	s := &Session{client: whatsmeow.NewClient(device, newLogger("Client"))}
+	if device.ID != nil {
+		s.setJID(*device.ID, device.LID)
+	}
+	// Dropped connections are retried by startReconnect instead
+	s.client.EnableAutoReconnect = false
+	s.dispatcher = newEventDispatcher(eventWorkers, eventQueueSize, s.handleMessage)
+	s.client.AddEventHandler(s.handleEvent)
+	return s
+}
+
+// ID returns the phone number of the session's account, which is how the
+// session is addressed in /api/{session}/... routes. It is empty until the
+// device has been paired.
+func (s *Session) ID() string {
+	return s.JID().User
+}
+
+// JID returns the device JID of the session's account, or an empty JID
+// while the device isn't paired.
+func (s *Session) JID() types.JID {
+	s.jidMu.RLock()
+	defer s.jidMu.RUnlock()
+	return s.jid
+}
+
+// setJID records the account the device was paired with; empty JIDs mark
+// it as logged out.
+func (s *Session) setJID(jid, lid types.JID) {
+	s.jidMu.Lock()
+	defer s.jidMu.Unlock()
+	s.jid, s.lid = jid, lid
+}
+
+// ownsUser reports whether a JID user part, a phone number or LID, is the
+// session's account.
+func (s *Session) ownsUser(user string) bool {
+	s.jidMu.RLock()
+	defer s.jidMu.RUnlock()
+	return user != "" && (user == s.jid.User || user == s.lid.User)
+}
+
+// ownJIDs returns the session account's phone number and LID addresses.
+func (s *Session) ownJIDs() []types.JID {
+	s.jidMu.RLock()
+	defer s.jidMu.RUnlock()
+	return []types.JID{s.jid, s.lid}
+}
+
+// sendMessage sends a message and stores it, so chat history includes our
+// side of the conversation. Storage failures are logged but don't fail the
+// send, since the message has already gone out.
+func (s *Session) sendMessage(ctx context.Context, to types.JID, msg *waProto.Message) (whatsmeow.SendResponse, error) {
+	resp, err := s.client.SendMessage(ctx, to, msg)
+	messagesSent.WithLabelValues(resultLabel(err)).Inc()
+	if err != nil {
+		return resp, err
+	}
+	serializedMsg, err := proto.Marshal(msg)
+	if err != nil {
+		dbLog.Errorf("Failed to serialize sent message %s for storage: %v", resp.ID, err)
+		return resp, nil
+	}
+	var sender types.JID
+	if id := s.JID(); !id.IsEmpty() {
+		sender = id.ToNonAD()
+	}
+	if err := messageWriter.Store(s.ID(), resp.ID, to, sender, true, serializedMsg, resp.Timestamp); err != nil {
+		dbLog.Errorf("Failed to store sent message %s: %v", resp.ID, err)
+	}
+	return resp, nil
+}
+
+// sessionRegistry tracks all sessions, paired or waiting to be paired.
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions []*Session
+}
+
+var sessions = &sessionRegistry{}
+
+func (r *sessionRegistry) Add(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions = append(r.sessions, s)
+}
+
+// Remove drops a session from the registry. It doesn't disconnect it.
+func (r *sessionRegistry) Remove(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, existing := range r.sessions {
+		if existing == s {
+			r.sessions = append(r.sessions[:i], r.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get returns the paired session with the given ID, or nil.
+func (r *sessionRegistry) Get(id string) *Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.sessions {
+		if id != "" && s.ID() == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// Default returns the session used by routes without a session segment: the
+// first paired session, or the first session if none is paired yet.
+func (r *sessionRegistry) Default() *Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, s := range r.sessions {
+		if s.ID() != "" {
+			return s
+		}
+	}
+	if len(r.sessions) > 0 {
+		return r.sessions[0]
+	}
+	return nil
+}
+
+func (r *sessionRegistry) All() []*Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]*Session(nil), r.sessions...)
+}
+
+// IsOwnUser reports whether a JID user part belongs to one of our accounts.
+func (r *sessionRegistry) IsOwnUser(user string) bool {
+	return user != "" && r.Get(user) != nil
+}
+
+func (r *sessionRegistry) DisconnectAll() {
+	for _, s := range r.All() {
+		s.client.Disconnect()
+	}
+}
+
+// sessionFromRequest resolves the session addressed by the {session} route
+// variable, or the default session for routes without one. It writes a 404
+// and returns false if there is no such session.
+func sessionFromRequest(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	var s *Session
+	if id, ok := mux.Vars(r)["session"]; ok {
+		s = sessions.Get(id)
+	} else {
+		s = sessions.Default()
+	}
+	if s == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return nil, false
+	}
+	return s, true
+}
+
+// connectedSessionFromRequest resolves the session like sessionFromRequest
+// and answers with a 503 when it can't send: "not_connected" when it isn't
+// connected to WhatsApp, "not_logged_in" while it waits to be paired and
+// "logging_out" during a logout. Sends then fail clearly instead of deep
+// inside whatsmeow.
+func connectedSessionFromRequest(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return nil, false
+	}
+	switch {
+	case s.loggingOut.Load():
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"error": "session is logging out",
+			"code":  "logging_out",
+		})
+		return nil, false
+	case !s.client.IsConnected():
+		writeNotConnected(w, s)
+		return nil, false
+	case !s.client.IsLoggedIn():
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"error": "not logged in to WhatsApp",
+			"code":  "not_logged_in",
+		})
+		return nil, false
+	}
+	return s, true
+}
+
+// writeNotConnected answers with the 503 "not_connected" error.
+func writeNotConnected(w http.ResponseWriter, s *Session) {
+	writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+		"error":        "not connected to WhatsApp",
+		"code":         "not_connected",
+		"reconnecting": s.reconnecting.Load(),
+	})
+}
+
+// SessionInfo summarizes a session for GET /api/sessions and GET /api/status.
+type SessionInfo struct {
+	ID           string `json:"id"`
+	DeviceJID    string `json:"deviceJID,omitempty"`
+	PushName     string `json:"pushName,omitempty"`
+	Connected    bool   `json:"connected"`
+	Reconnecting bool   `json:"reconnecting"`
+	LoggedIn     bool   `json:"loggedIn"`
+	// LastConnected is when the session last connected successfully.
+	LastConnected     string `json:"lastConnected,omitempty"`
+	LastConnectedUnix int64  `json:"lastConnectedUnix,omitempty"`
+}
+
+func (s *Session) Info() SessionInfo {
+	info := SessionInfo{
+		ID:           s.ID(),
+		PushName:     s.client.Store.PushName,
+		Connected:    s.client.IsConnected(),
+		Reconnecting: s.reconnecting.Load(),
+		LoggedIn:     s.client.IsLoggedIn(),
+	}
+	if id := s.JID(); !id.IsEmpty() {
+		info.DeviceJID = id.String()
+	}
+	if ts := s.lastConnected.Load(); ts > 0 {
+		info.LastConnected = time.Unix(ts, 0).UTC().Format(time.RFC3339)
+		info.LastConnectedUnix = ts
+	}
+	return info
+}
+
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	infos := []SessionInfo{}
+	for _, s := range sessions.All() {
+		infos = append(infos, s.Info())
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// handleCreateSession adds a new device and starts pairing it. QR codes are
+// pushed to the agent's /api/qr; once paired the session is reachable under
+// /api/{phone number}/....
+func handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	s := newSession(container.NewDevice())
+	if err := s.startQRLogin(); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to start login: " + err.Error()})
+		return
+	}
+	sessions.Add(s)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "qr_pending"})
+}
+
+// handleDeleteSession logs an account out and removes its session, without
+// starting a new pairing like POST /api/logout does. With force=true the
+// local session is cleared even if the server-side logout fails.
+func handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	s, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	s.loginMu.Lock()
+	defer s.loginMu.Unlock()
+	s.loggingOut.Store(true)
+	defer s.loggingOut.Store(false)
+
+	result := map[string]interface{}{"status": "removed"}
+	if s.ID() != "" {
+		force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+		warning, err := s.logout(r.Context(), force)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to log out: " + err.Error()})
+			return
+		}
+		if warning != "" {
+			result["warning"] = warning
+		}
+	}
+	s.stopReconnect()
+	s.client.Disconnect()
+	sessions.Remove(s)
+	log.Infof("Removed session %s", mux.Vars(r)["session"])
+	writeJSON(w, http.StatusOK, result)
+}
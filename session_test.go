@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestSessionOwnsUser(t *testing.T) {
+	s := &Session{}
+	if s.ownsUser("") || s.ID() != "" {
+		t.Fatal("unpaired session claims an account")
+	}
+	s.setJID(types.NewADJID("919812345678", 0, 12), types.NewJID("123456789", types.HiddenUserServer))
+	tests := []struct {
+		user string
+		want bool
+	}{
+		{"919812345678", true},
+		{"123456789", true},
+		{"919800000000", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := s.ownsUser(tt.user); got != tt.want {
+			t.Errorf("ownsUser(%q) = %t, want %t", tt.user, got, tt.want)
+		}
+	}
+	if got := s.ID(); got != "919812345678" {
+		t.Errorf("ID() = %q, want the phone number", got)
+	}
+
+	s.setJID(types.EmptyJID, types.EmptyJID)
+	if s.ownsUser("919812345678") || s.ID() != "" {
+		t.Error("logged out session still claims its account")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventStream fans the payloads posted to the agent out to the clients of
+// GET /api/events.
+var eventStream *eventHub
+
+// sseKeepAlive is how often an idle event stream gets a comment line, so
+// proxies don't close it (SSE_KEEPALIVE).
+var sseKeepAlive = 15 * time.Second
+
+// streamEvent is a Server-Sent Event: its name is the agent endpoint the
+// payload is posted to, e.g. "message" or "status", and data the JSON body.
+type streamEvent struct {
+	name string
+	data []byte
+}
+
+// eventHub keeps one buffered channel per subscriber. Publishing never
+// blocks: a subscriber that falls a whole buffer behind is dropped and its
+// channel closed, which ends its stream so the client reconnects.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan streamEvent]struct{}
+	bufferSize  int
+}
+
+func newEventHub(bufferSize int) *eventHub {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	return &eventHub{subscribers: make(map[chan streamEvent]struct{}), bufferSize: bufferSize}
+}
+
+func (h *eventHub) Subscribe() chan streamEvent {
+	ch := make(chan streamEvent, h.bufferSize)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe removes a subscriber and closes its channel, unless it was
+// already dropped.
+func (h *eventHub) Unsubscribe(ch chan streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (h *eventHub) Publish(name string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- streamEvent{name: name, data: data}:
+		default:
+			apiLog.Warnf("Event stream subscriber is %d events behind, disconnecting it", h.bufferSize)
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishEvent streams a payload posted to the agent endpoint at path.
+func publishEvent(path string, data []byte) {
+	if eventStream == nil {
+		return
+	}
+	eventStream.Publish(strings.TrimPrefix(path, "/api/"), data)
+}
+
+// statusQueueKey pins a session's status posts to one dispatcher worker, so
+// the agent receives them in the order they happened.
+const statusQueueKey = "status"
+
+// postStatus tells the agent and event stream subscribers about a status
+// change of the session. The POST, with its retries, runs on the session's
+// dispatcher rather than on the caller's goroutine, which is usually the
+// whatsmeow event loop or an HTTP handler.
+func (s *Session) postStatus(status map[string]string) {
+	if data, err := json.Marshal(status); err == nil {
+		publishEvent("/api/status", data)
+	}
+	s.dispatcher.Run(statusQueueKey, func() {
+		if err := postJSON(agentBaseURL+"/api/status", status); err != nil {
+			agentLog.Errorf("Failed to post status to agent: %v", err)
+		}
+	})
+}
+
+// handleEvents streams everything posted to the agent (messages, status
+// changes, receipts, group events and poll votes) as Server-Sent Events, for
+// clients that would rather subscribe than receive webhooks. Events that
+// happen while no client is connected are not replayed. Clients must present
+// the API key, like those of /ws.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !authorizeStream(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	stream := eventStream.Subscribe()
+	defer eventStream.Unsubscribe(stream)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case evt, ok := <-stream:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.name, evt.data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
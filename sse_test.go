@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withAPIKey sets API_KEY and a fresh event hub for the duration of a test.
+func withAPIKey(t *testing.T, key string) {
+	t.Helper()
+	prevKey, prevStream := apiKey, eventStream
+	apiKey, eventStream = key, newEventHub(4)
+	t.Cleanup(func() { apiKey, eventStream = prevKey, prevStream })
+}
+
+func TestEventsAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		apiKey string
+		header http.Header
+		query  string
+		want   int
+	}{
+		{name: "disabled without API_KEY", want: http.StatusServiceUnavailable},
+		{name: "disabled even with a key", header: http.Header{"X-Api-Key": {"secret"}}, want: http.StatusServiceUnavailable},
+		{name: "missing key", apiKey: "secret", want: http.StatusUnauthorized},
+		{name: "wrong header key", apiKey: "secret", header: http.Header{"X-Api-Key": {"guess"}}, want: http.StatusUnauthorized},
+		{name: "wrong bearer token", apiKey: "secret", header: http.Header{"Authorization": {"Bearer guess"}}, want: http.StatusUnauthorized},
+		{name: "wrong query key", apiKey: "secret", query: "?api_key=guess", want: http.StatusUnauthorized},
+		{name: "key prefix", apiKey: "secret", header: http.Header{"X-Api-Key": {"secre"}}, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAPIKey(t, tt.apiKey)
+			req := httptest.NewRequest(http.MethodGet, "/api/events"+tt.query, nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			handleEvents(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if got := len(eventStream.subscribers); got != 0 {
+				t.Errorf("rejected request left %d subscribers", got)
+			}
+		})
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	for _, auth := range []struct {
+		name   string
+		header string
+		value  string
+		query  string
+	}{
+		{name: "header", header: "X-Api-Key", value: "secret"},
+		{name: "bearer", header: "Authorization", value: "Bearer secret"},
+		{name: "query", query: "?api_key=secret"},
+	} {
+		t.Run(auth.name, func(t *testing.T) {
+			withAPIKey(t, "secret")
+			srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+auth.query, nil)
+			if auth.header != "" {
+				req.Header.Set(auth.header, auth.value)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("Content-Type = %q, want text/event-stream", ct)
+			}
+
+			lines := bufio.NewScanner(resp.Body)
+			if !lines.Scan() || lines.Text() != ": connected" {
+				t.Fatalf("first line = %q, want \": connected\"", lines.Text())
+			}
+			// The client is subscribed once the greeting arrives
+			publishEvent("/api/status", []byte(`{"status":"logged_in"}`))
+			var got []string
+			for lines.Scan() && len(got) < 2 {
+				if line := lines.Text(); line != "" {
+					got = append(got, line)
+				}
+			}
+			want := "event: status\ndata: {\"status\":\"logged_in\"}"
+			if strings.Join(got, "\n") != want {
+				t.Errorf("event = %q, want %q", strings.Join(got, "\n"), want)
+			}
+		})
+	}
+}
+
+func TestEventHubDropsSlowSubscribers(t *testing.T) {
+	hub := newEventHub(2)
+	slow := hub.Subscribe()
+	fast := hub.Subscribe()
+	for i := 0; i < 3; i++ {
+		hub.Publish("message", []byte("{}"))
+		<-fast
+	}
+	if _, ok := hub.subscribers[slow]; ok {
+		t.Fatal("subscriber that fell a whole buffer behind is still subscribed")
+	}
+	if n := len(slow); n != 2 {
+		t.Errorf("dropped subscriber has %d buffered events, want 2", n)
+	}
+	if _, ok := hub.subscribers[fast]; !ok {
+		t.Error("subscriber that kept up was dropped")
+	}
+	// Unsubscribing a dropped subscriber must not close its channel twice
+	hub.Unsubscribe(slow)
+	hub.Unsubscribe(fast)
+}
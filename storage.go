@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// storeQueueSize is the number of messages that may wait for the storage
+// writer (STORE_QUEUE_SIZE).
+var storeQueueSize = 1000
+
+// messageWriter stores received and sent messages one at a time.
+var messageWriter *storageWriter
+
+// storageWriter inserts messages on a single goroutine in the order they
+// were queued. Received messages are handled by several dispatcher workers
+// and sent messages by API requests; funneling their inserts through one
+// queue keeps the table in receive order and avoids concurrent writers
+// contending for the database lock.
+type storageWriter struct {
+	queue chan storeRequest
+}
+
+type storeRequest struct {
+	sessionID string
+	msgID     string
+	chatJID   types.JID
+	senderJID types.JID
+	fromMe    bool
+	content   []byte
+	timestamp time.Time
+	done      chan error
+}
+
+// newStorageWriter starts the writer goroutine with a queue holding up to
+// queueSize pending messages.
+func newStorageWriter(queueSize int) *storageWriter {
+	w := &storageWriter{queue: make(chan storeRequest, queueSize)}
+	go func() {
+		for req := range w.queue {
+			_, err := storeMessage(req.sessionID, req.msgID, req.chatJID, req.senderJID, req.fromMe, req.content, req.timestamp)
+			req.done <- err
+		}
+	}()
+	return w
+}
+
+// Store queues a message received or sent by the session sessionID and
+// waits until it has been written, so that history read afterwards includes
+// it.
+func (w *storageWriter) Store(sessionID, msgID string, chatJID, senderJID types.JID, fromMe bool, content []byte, timestamp time.Time) error {
+	req := storeRequest{
+		sessionID: sessionID,
+		msgID:     msgID,
+		chatJID:   chatJID,
+		senderJID: senderJID,
+		fromMe:    fromMe,
+		content:   content,
+		timestamp: timestamp,
+		done:      make(chan error, 1),
+	}
+	select {
+	case w.queue <- req:
+	default:
+		dbLog.Warnf("Storage queue is full, waiting to store message %s", msgID)
+		w.queue <- req
+	}
+	return <-req.done
+}
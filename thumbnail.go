@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// thumbnailMaxSide is the longest side of thumbnails generated from full
+// images.
+const thumbnailMaxSide = 200
+
+// thumbnailMaxPixels bounds the images decoded for a thumbnail. A small file
+// can claim huge dimensions, and decoding allocates for every pixel, so the
+// size is checked before decoding. At 40 megapixels, WhatsApp's own images
+// stay well below it.
+const thumbnailMaxPixels = 40000000
+
+// embeddedThumbnail returns the preview embedded in a media message and its
+// content type, or nil if it has none.
+func embeddedThumbnail(media interface{}) ([]byte, string) {
+	switch m := media.(type) {
+	case *waProto.ImageMessage:
+		return m.GetJPEGThumbnail(), "image/jpeg"
+	case *waProto.VideoMessage:
+		return m.GetJPEGThumbnail(), "image/jpeg"
+	case *waProto.DocumentMessage:
+		return m.GetJPEGThumbnail(), "image/jpeg"
+	case *waProto.StickerMessage:
+		return m.GetPngThumbnail(), "image/png"
+	}
+	return nil, ""
+}
+
+// handleThumbnail returns the thumbnail embedded in an image, video, document
+// or sticker message. Images without one are downloaded and scaled down.
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	messageID := mux.Vars(r)["messageID"]
+	media, ok := mediaMap.Load(messageID)
+	if !ok {
+		stored, err := loadStoredMessage(messageID)
+		if err != nil {
+			http.Error(w, "Media not found", http.StatusNotFound)
+			return
+		}
+		if media = messageMedia(stored); media == nil {
+			http.Error(w, "Message has no media", http.StatusNotFound)
+			return
+		}
+	}
+	if thumbnail, contentType := embeddedThumbnail(media); len(thumbnail) > 0 {
+		writeImage(w, contentType, thumbnail)
+		return
+	}
+
+	img, ok := media.(*waProto.ImageMessage)
+	if !ok {
+		http.Error(w, "No thumbnail available for this media", http.StatusNotFound)
+		return
+	}
+	if exceedsMaxMediaBytes(img.GetFileLength()) {
+		http.Error(w, "Image is larger than the configured maximum", http.StatusRequestEntityTooLarge)
+		return
+	}
+	sess, ok := connectedSessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), downloadTimeout)
+	defer cancel()
+	data, err := sess.client.Download(ctx, whatsmeow.DownloadableMessage(img))
+	if err != nil {
+		writeOperationError(w, "Failed to download image", err)
+		return
+	}
+	thumbnail, err := scaleToJPEG(data, thumbnailMaxSide)
+	if err != nil {
+		http.Error(w, "Failed to create thumbnail: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeImage(w, "image/jpeg", thumbnail)
+}
+
+// scaleToJPEG decodes a JPEG or PNG image and encodes a copy whose longest
+// side is at most maxSide, using box sampling. Images of more than
+// thumbnailMaxPixels pixels are rejected without being decoded.
+func scaleToJPEG(data []byte, maxSide int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > thumbnailMaxPixels {
+		return nil, fmt.Errorf("image is %dx%d, more than %d pixels", config.Width, config.Height, thumbnailMaxPixels)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width > maxSide || height > maxSide {
+		if width >= height {
+			width, height = maxSide, max(1, height*maxSide/b.Dx())
+		} else {
+			width, height = max(1, width*maxSide/b.Dy()), maxSide
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeImage writes image bytes as the response.
+func writeImage(w http.ResponseWriter, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// testPNG encodes a blank PNG and then rewrites the dimensions in its header
+// to width x height, so it can claim to be larger than it is.
+func testPNG(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 400, 100))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8-byte signature: length, type, then the
+	// width and height, and its CRC after the 13 bytes of data
+	ihdr := data[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:4], width)
+	binary.BigEndian.PutUint32(ihdr[4:8], height)
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+func TestScaleToJPEG(t *testing.T) {
+	thumbnail, err := scaleToJPEG(testPNG(t, 400, 100), thumbnailMaxSide)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Width != thumbnailMaxSide || img.Height != thumbnailMaxSide/4 {
+		t.Errorf("thumbnail is %dx%d, want %dx%d", img.Width, img.Height, thumbnailMaxSide, thumbnailMaxSide/4)
+	}
+
+	// A few hundred bytes claiming 100000x100000 pixels must not be decoded
+	if _, err := scaleToJPEG(testPNG(t, 100000, 100000), thumbnailMaxSide); err == nil || !strings.Contains(err.Error(), "pixels") {
+		t.Errorf("image over thumbnailMaxPixels: err = %v, want it rejected for its size", err)
+	}
+	if _, err := scaleToJPEG([]byte("not an image"), thumbnailMaxSide); err == nil {
+		t.Error("invalid image was scaled")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// apiKey authenticates the event streams, GET /api/events and /ws
+// (API_KEY). Both are disabled while it isn't set, since they carry message
+// contents and the socket can send messages.
+var apiKey string
+
+// wsPingInterval is how often the server pings WebSocket clients
+// (WS_PING_INTERVAL). A client that doesn't answer within two intervals is
+// disconnected.
+var wsPingInterval = 30 * time.Second
+
+const (
+	// maxWSFrameBytes bounds incoming frames, which may carry base64 media.
+	maxWSFrameBytes = 32 << 20
+	wsWriteTimeout  = 10 * time.Second
+	// wsCommandQueueSize bounds the send commands of a connection waiting
+	// to be sent; further commands are answered with a "busy" error.
+	wsCommandQueueSize = 16
+)
+
+var wsUpgrader = websocket.Upgrader{CheckOrigin: wsOriginAllowed}
+
+// wsOriginAllowed accepts clients without an Origin (anything but a
+// browser), pages served from this host and the ALLOWED_ORIGINS.
+func wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || corsAllowAnyOrigin || corsAllowedOrigins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// requestAPIKey returns the API key of a request: the X-Api-Key header, a
+// bearer token, or the api_key query parameter for browsers, which can't set
+// headers on WebSocket connections or EventSource requests.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// authorizeStream checks the API key of a request to an event stream and
+// answers 503 while API_KEY isn't set or 401 for a wrong key.
+func authorizeStream(w http.ResponseWriter, r *http.Request) bool {
+	if apiKey == "" {
+		http.Error(w, "Event streams are disabled, set API_KEY to enable them", http.StatusServiceUnavailable)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(requestAPIKey(r)), []byte(apiKey)) != 1 {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// WSSendFrame is a send command received over /ws: a SendMessageRequest with
+// an optional requestId that is echoed in the answer.
+type WSSendFrame struct {
+	RequestID string `json:"requestId,omitempty"`
+	SendMessageRequest
+}
+
+// WSFrame is a frame sent over /ws. Event is the webhook name for streamed
+// events ("message", "status", ...), "send_result" for the answer to a send
+// command or "error".
+type WSFrame struct {
+	Event     string      `json:"event"`
+	RequestID string      `json:"requestId,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Code      string      `json:"code,omitempty"`
+}
+
+// sendUnavailable returns the error code and message of
+// connectedSessionFromRequest when the session can't send, or "" when it can.
+func (s *Session) sendUnavailable() (string, string) {
+	switch {
+	case s.loggingOut.Load():
+		return "logging_out", "session is logging out"
+	case !s.client.IsConnected():
+		return "not_connected", "not connected to WhatsApp"
+	case !s.client.IsLoggedIn():
+		return "not_logged_in", "not logged in to WhatsApp"
+	}
+	return "", ""
+}
+
+// handleSendFrame sends the message of a send command. Its answer has the
+// shape of POST /api/send's: a SendResult, or the results per recipient when
+// the frame lists recipients. Failures of single sends are reported as
+// errors.
+func (s *Session) handleSendFrame(ctx context.Context, frame WSSendFrame) WSFrame {
+	answer := WSFrame{Event: "send_result", RequestID: frame.RequestID}
+	fail := func(code, message string) WSFrame {
+		return WSFrame{Event: "error", RequestID: frame.RequestID, Code: code, Error: message}
+	}
+	if code, message := s.sendUnavailable(); code != "" {
+		return fail(code, message)
+	}
+	mentions, err := parseMentions(frame.Mentions)
+	if err != nil {
+		return fail("invalid_request", err.Error())
+	}
+	if err := validateExpiration(frame.ExpirationSeconds); err != nil {
+		return fail("invalid_request", err.Error())
+	}
+	if len(frame.Recipients) == 0 {
+		result := s.sendToRecipient(ctx, frame.JID, frame.SendMessageRequest, mentions)
+		if result.Error != "" {
+			return fail("send_failed", result.Error)
+		}
+		answer.Data = result
+		return answer
+	}
+	recipients, err := batchRecipients(frame.JID, frame.Recipients)
+	if err != nil {
+		return fail("invalid_request", err.Error())
+	}
+	results := make([]SendResult, 0, len(recipients))
+	for i, recipient := range recipients {
+		// The connection's context ends when the socket closes
+		if i > 0 && !waitSendDelay(ctx) {
+			apiLog.Warnf("WebSocket send %s cancelled after %d of %d recipients", frame.RequestID, i, len(recipients))
+			return fail("cancelled", "connection closed")
+		}
+		results = append(results, s.sendToRecipient(ctx, recipient, frame.SendMessageRequest, mentions))
+	}
+	answer.Data = map[string]interface{}{"results": results}
+	return answer
+}
+
+// handleWebSocket streams the events of GET /api/events over a WebSocket and
+// accepts send commands as JSON frames, answering each with a "send_result"
+// or "error" frame that echoes its requestId. Commands are sent one at a time
+// in the order they arrive; the connection must present the API key.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !authorizeStream(w, r) {
+		return
+	}
+	sess, ok := sessionFromRequest(w, r)
+	if !ok {
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered already
+		apiLog.Warnf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	stream := eventStream.Subscribe()
+	defer eventStream.Unsubscribe(stream)
+	apiLog.Infof("WebSocket client connected from %s", r.RemoteAddr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	answers := make(chan WSFrame)
+	answer := func(frame WSFrame) bool {
+		select {
+		case answers <- frame:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// A send may take up to SEND_TIMEOUT per recipient, longer than the pong
+	// deadline, so commands are sent from their own goroutine while the
+	// reader below keeps handling pongs
+	commands := make(chan WSSendFrame, wsCommandQueueSize)
+	go func() {
+		for {
+			select {
+			case frame := <-commands:
+				if !answer(sess.handleSendFrame(ctx, frame)) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		// Reading fails once the client goes away or stops answering pings,
+		// which ends the write loop below
+		defer cancel()
+		pongWait := 2 * wsPingInterval
+		conn.SetReadLimit(maxWSFrameBytes)
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(pongWait))
+		})
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var frame WSSendFrame
+			if err := json.Unmarshal(data, &frame); err != nil {
+				if !answer(WSFrame{Event: "error", Code: "invalid_request", Error: err.Error()}) {
+					return
+				}
+				continue
+			}
+			select {
+			case commands <- frame:
+			default:
+				busy := WSFrame{Event: "error", RequestID: frame.RequestID, Code: "busy",
+					Error: fmt.Sprintf("%d sends are already waiting, try again once they are answered", wsCommandQueueSize)}
+				if !answer(busy) {
+					return
+				}
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			apiLog.Infof("WebSocket client %s disconnected", r.RemoteAddr)
+			return
+		case evt, ok := <-stream:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too far behind"), time.Now().Add(wsWriteTimeout))
+				return
+			}
+			err = writeWSFrame(conn, WSFrame{Event: evt.name, Data: json.RawMessage(evt.data)})
+		case answer := <-answers:
+			err = writeWSFrame(conn, answer)
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		}
+		if err != nil {
+			apiLog.Warnf("WebSocket client %s dropped: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+func writeWSFrame(conn *websocket.Conn, frame WSFrame) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteJSON(frame)
+}
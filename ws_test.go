@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+)
+
+// withSession registers an unpaired, disconnected session for the duration
+// of a test.
+func withSession(t *testing.T) *Session {
+	t.Helper()
+	c, err := sqlstore.New(context.Background(), "sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared&_foreign_keys=on", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSession(c.NewDevice())
+	sessions.Add(s)
+	t.Cleanup(func() { sessions.Remove(s) })
+	return s
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		apiKey string
+		header http.Header
+		want   int
+	}{
+		{name: "disabled without API_KEY", header: http.Header{"X-Api-Key": {"secret"}}, want: http.StatusServiceUnavailable},
+		{name: "missing key", apiKey: "secret", want: http.StatusUnauthorized},
+		{name: "wrong key", apiKey: "secret", header: http.Header{"X-Api-Key": {"guess"}}, want: http.StatusUnauthorized},
+		{name: "wrong bearer token", apiKey: "secret", header: http.Header{"Authorization": {"Bearer guess"}}, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAPIKey(t, tt.apiKey)
+			srv := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+			defer srv.Close()
+			conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), tt.header)
+			if err == nil {
+				conn.Close()
+				t.Fatal("upgrade succeeded without a valid key")
+			}
+			if resp == nil || resp.StatusCode != tt.want {
+				t.Fatalf("response = %v, want status %d", resp, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketCommandsAndEvents(t *testing.T) {
+	withAPIKey(t, "secret")
+	withSession(t)
+	srv := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?api_key=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() WSFrame {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var frame WSFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+
+	// The session isn't connected, so the send fails without reaching WhatsApp
+	conn.WriteJSON(map[string]string{"requestId": "r1", "jid": "919812345678", "message": "hi"})
+	if got := read(); got.Event != "error" || got.Code != "not_connected" || got.RequestID != "r1" {
+		t.Errorf("send answer = %+v, want a not_connected error for r1", got)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("{not json"))
+	if got := read(); got.Event != "error" || got.Code != "invalid_request" {
+		t.Errorf("invalid frame answer = %+v, want an invalid_request error", got)
+	}
+
+	publishEvent("/api/receipt", []byte(`{"status":"read"}`))
+	got := read()
+	if got.Event != "receipt" {
+		t.Fatalf("event = %+v, want a receipt", got)
+	}
+	if data, ok := got.Data.(map[string]interface{}); !ok || data["status"] != "read" {
+		t.Errorf("event data = %v, want the published payload", got.Data)
+	}
+}